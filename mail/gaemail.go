@@ -1,6 +1,8 @@
 package mail
 
 import (
+	netmail "net/mail"
+
 	"golang.org/x/net/context"
 	gaemail "google.golang.org/appengine/mail"
 )
@@ -14,15 +16,40 @@ func newGAEMailClient(ctx context.Context) *gaeMailClient {
 }
 
 func (g *gaeMailClient) Send(from, subject, content, contentType string, to []string) error {
+	return g.SendMessage(g.ctx, newSimpleMessage(from, subject, content, contentType, to))
+}
+
+// SendMessage sends message using app engine mail api.
+//
+// Display name of from is kept, but app engine accepts only authorized senders.
+func (g *gaeMailClient) SendMessage(ctx context.Context, m *Message) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
 	msg := &gaemail.Message{
-		Sender:  from,
-		To:      to,
-		Subject: subject,
+		Sender:  m.From.String(),
+		To:      addressStrings(m.To),
+		Cc:      addressStrings(m.Cc),
+		Bcc:     addressStrings(m.Bcc),
+		Subject: m.Subject,
+	}
+	if m.ReplyTo != nil {
+		msg.ReplyTo = m.ReplyTo.String()
+	}
+	msg.Body = m.text()
+	msg.HTMLBody = m.HTML
+	if len(m.Headers) > 0 {
+		msg.Headers = make(netmail.Header, len(m.Headers))
+		for k, v := range m.Headers {
+			msg.Headers[k] = []string{v}
+		}
 	}
-	if contentType == "text/html" {
-		msg.HTMLBody = content
-	} else {
-		msg.Body = content
+	for _, a := range m.Attachments {
+		att := gaemail.Attachment{Name: a.Filename, Data: a.Data}
+		if a.Inline {
+			att.ContentID = "<" + a.ContentID + ">"
+		}
+		msg.Attachments = append(msg.Attachments, att)
 	}
-	return gaemail.Send(g.ctx, msg)
+	return gaemail.Send(ctx, msg)
 }
@@ -1,27 +1,32 @@
 package mail
 
 import (
-	"github.com/koichirokamoto/gko/util"
+	"encoding/base64"
+
+	"golang.org/x/net/context"
 	gmail "google.golang.org/api/gmail/v1"
 )
 
 type gmailClient struct {
+	ctx context.Context
 	srv *gmail.Service
 }
 
 func (g *gmailClient) Send(from, subject, content, contentType string, to []string) error {
-	var headers []*gmail.MessagePartHeader
-	part := &gmail.MessagePartBody{}
-	body := &gmail.MessagePart{
-		Headers:  headers,
-		Body:     part,
-		MimeType: contentType,
+	return g.SendMessage(g.ctx, newSimpleMessage(from, subject, content, contentType, to))
+}
+
+// SendMessage sends message as user of from address.
+//
+// Message is sent as base64url encoded MIME, gmail reads recipients including bcc from its headers.
+func (g *gmailClient) SendMessage(ctx context.Context, m *Message) error {
+	raw, err := BuildMIME(m, true)
+	if err != nil {
+		return err
 	}
 	msg := &gmail.Message{
-		Id:      util.RandSeq(32),
-		Payload: body,
-		Raw:     "",
+		Raw: base64.URLEncoding.EncodeToString(raw),
 	}
-	_, err := g.srv.Users.Messages.Send(from, msg).Do()
+	_, err = g.srv.Users.Messages.Send(m.From.Email, msg).Context(ctx).Do()
 	return err
 }
@@ -0,0 +1,320 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/koichirokamoto/gko/log"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html/charset"
+	"google.golang.org/appengine"
+)
+
+const (
+	// InboundMailPath is path prefix of mail received by app engine, recipient address follows it.
+	InboundMailPath = "/_ah/mail/"
+
+	// maxInboundMailBody is max size of received mail, app engine accepts mail up to 31.5MB.
+	maxInboundMailBody = 32 << 20
+)
+
+// InboundMessage is mail received by app engine.
+type InboundMessage struct {
+	// Recipient is address of request path, it may be bcc recipient which is not in To and Cc.
+	Recipient string
+
+	From      Address
+	To        []Address
+	Cc        []Address
+	ReplyTo   []Address
+	Subject   string
+	Date      time.Time
+	MessageID string
+	// Header is raw header of message.
+	Header netmail.Header
+
+	// Text and HTML are bodies decoded to utf-8, body of unknown charset is kept as it is.
+	// Multiple parts of the same type are joined with newline.
+	Text        string
+	HTML        string
+	Attachments []*Attachment
+}
+
+// wordDecoder decodes RFC 2047 encoded-words of any charset supported by x/net/html/charset.
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: charset.NewReaderLabel,
+}
+
+// lenientWordDecoder is wordDecoder which keeps bytes of unknown charset as they are.
+var lenientWordDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		if r, err := charset.NewReaderLabel(label, input); err == nil {
+			return r, nil
+		}
+		return input, nil
+	},
+}
+
+// ParseInboundMessage parses RFC 822 message.
+//
+// Headers which can not be decoded are not errors, raw header is used instead so that message is not lost.
+func ParseInboundMessage(r io.Reader) (*InboundMessage, error) {
+	msg, err := netmail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &InboundMessage{Header: msg.Header}
+	m.Subject = decodeHeader(msg.Header.Get("Subject"))
+	m.MessageID = strings.Trim(msg.Header.Get("Message-Id"), "<>")
+	if d, err := msg.Header.Date(); err == nil {
+		m.Date = d
+	}
+
+	if from := parseAddressList(msg.Header.Get("From")); len(from) > 0 {
+		m.From = from[0]
+	}
+	m.To = parseAddressList(msg.Header.Get("To"))
+	m.Cc = parseAddressList(msg.Header.Get("Cc"))
+	m.ReplyTo = parseAddressList(msg.Header.Get("Reply-To"))
+
+	h := textproto.MIMEHeader(msg.Header)
+	if err := m.parsePart(h, msg.Body); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodeHeader decodes encoded-words of header, it return raw header if charset is unknown or word is broken.
+func decodeHeader(s string) string {
+	d, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return d
+}
+
+// parseAddressList parses address list leniently.
+//
+// If list is malformed, each comma separated address is parsed, name of unknown charset is decoded
+// as raw bytes, and address which can not be parsed is kept as raw string in Email.
+func parseAddressList(s string) []Address {
+	if s == "" {
+		return nil
+	}
+	p := &netmail.AddressParser{WordDecoder: wordDecoder}
+	if list, err := p.ParseList(s); err == nil {
+		addrs := make([]Address, len(list))
+		for i, a := range list {
+			addrs[i] = Address{Name: a.Name, Email: a.Address}
+		}
+		return addrs
+	}
+
+	var addrs []Address
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		a, err := (&netmail.AddressParser{WordDecoder: lenientWordDecoder}).Parse(part)
+		if err != nil {
+			addrs = append(addrs, Address{Email: part})
+			continue
+		}
+		addrs = append(addrs, Address{Name: a.Name, Email: a.Address})
+	}
+	return addrs
+}
+
+// parsePart parses body of part, multipart is parsed recursively.
+func (m *InboundMessage) parsePart(h textproto.MIMEHeader, body io.Reader) error {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		// broken content type is treated as binary attachment.
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.parsePart(p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = decodeHeader(filename)
+
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if isText && disposition != "attachment" && filename == "" {
+		text, err := decodeCharset(params["charset"], body)
+		if err != nil {
+			return err
+		}
+		if mediaType == "text/html" {
+			m.HTML = joinPart(m.HTML, text)
+		} else {
+			m.Text = joinPart(m.Text, text)
+		}
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.Attachments = append(m.Attachments, &Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Data:        data,
+		Inline:      disposition == "inline",
+		ContentID:   strings.Trim(h.Get("Content-Id"), "<>"),
+	})
+	return nil
+}
+
+// joinPart joins body of part to body of previous parts with newline.
+func joinPart(body, part string) string {
+	if body == "" {
+		return part
+	}
+	return body + "\n" + part
+}
+
+// decodeCharset reads body in charset as utf-8 string, body of unknown charset is read as it is.
+func decodeCharset(label string, body io.Reader) (string, error) {
+	if label != "" && !strings.EqualFold(label, "utf-8") && !strings.EqualFold(label, "us-ascii") {
+		if r, err := charset.NewReaderLabel(label, body); err == nil {
+			body = r
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(body); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// InboundMailFunc handles received mail.
+type InboundMailFunc func(context.Context, *InboundMessage) error
+
+// InboundMailHandler is http handler of InboundMailPath, it routes mail by recipient address.
+//
+// Route is looked up by full address, then by local part, then default route is used.
+type InboundMailHandler struct {
+	// Context return context of request, appengine.NewContext is used if it is nil.
+	Context func(*http.Request) context.Context
+
+	routes map[string]InboundMailFunc
+	def    InboundMailFunc
+}
+
+// NewInboundMailHandler return new inbound mail handler without routes.
+func NewInboundMailHandler() *InboundMailHandler {
+	return &InboundMailHandler{routes: make(map[string]InboundMailFunc)}
+}
+
+// Handle registers f for address, address is full address or local part, e.g. support or support@app.appspotmail.com.
+//
+// Routes must be registered before handler serves.
+func (h *InboundMailHandler) Handle(address string, f InboundMailFunc) {
+	h.routes[strings.ToLower(address)] = f
+}
+
+// HandleDefault registers f for mail which does not match any route.
+func (h *InboundMailHandler) HandleDefault(f InboundMailFunc) {
+	h.def = f
+}
+
+func (h *InboundMailHandler) route(recipient string) InboundMailFunc {
+	recipient = strings.ToLower(recipient)
+	if f, ok := h.routes[recipient]; ok {
+		return f
+	}
+	if i := strings.LastIndexByte(recipient, '@'); i >= 0 {
+		if f, ok := h.routes[recipient[:i]]; ok {
+			return f
+		}
+	}
+	return h.def
+}
+
+func (h *InboundMailHandler) context(r *http.Request) context.Context {
+	if h.Context == nil {
+		return appengine.NewContext(r)
+	}
+	return h.Context(r)
+}
+
+// ServeHTTP parses mail and calls its route.
+//
+// It responds 404 if no route matches, and 500 if route returns error.
+func (h *InboundMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := h.context(r)
+	if !strings.HasPrefix(r.URL.Path, InboundMailPath) {
+		http.NotFound(w, r)
+		return
+	}
+	recipient := strings.TrimPrefix(r.URL.Path, InboundMailPath)
+
+	f := h.route(recipient)
+	if f == nil {
+		log.DefaultLogger.Log(ctx, log.Warning, "no route of inbound mail to %s", recipient)
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxInboundMailBody))
+	if err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := ParseInboundMessage(bytes.NewReader(body))
+	if err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.Recipient = recipient
+	if err := f(ctx, m); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,167 @@
+package mail
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func TestParseInboundMessage(t *testing.T) {
+	raw, err := newTestMIMEBuilder(false).build(&Message{
+		From:    Address{Name: "送信者", Email: "from@example.com"},
+		To:      []Address{{Name: "To", Email: "to@example.com"}},
+		Cc:      []Address{{Email: "cc@example.com"}},
+		Subject: "件名",
+		Text:    "本文",
+		HTML:    "<p>本文</p>",
+		Attachments: []*Attachment{
+			{Filename: "logo.png", ContentType: "image/png", Data: []byte("png"), Inline: true, ContentID: "logo"},
+			{Filename: "報告書.txt", ContentType: "text/plain", Data: []byte("report")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ParseInboundMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From.Name != "送信者" || m.From.Email != "from@example.com" || len(m.To) != 1 || m.To[0].Name != "To" || len(m.Cc) != 1 {
+		t.Errorf("addresses are %+v %+v %+v", m.From, m.To, m.Cc)
+	}
+	if m.Subject != "件名" || m.Text != "本文" || m.HTML != "<p>本文</p>" || m.Date.IsZero() {
+		t.Errorf("message is %+v", m)
+	}
+	if len(m.Attachments) != 2 {
+		t.Fatalf("attachments are %d", len(m.Attachments))
+	}
+	logo, report := m.Attachments[0], m.Attachments[1]
+	if !logo.Inline || logo.ContentID != "logo" || logo.ContentType != "image/png" || string(logo.Data) != "png" {
+		t.Errorf("inline attachment is %+v", logo)
+	}
+	if report.Inline || report.Filename != "報告書.txt" || string(report.Data) != "report" {
+		t.Errorf("attachment is %+v", report)
+	}
+}
+
+func TestParseInboundMessageCharset(t *testing.T) {
+	body, err := japanese.ISO2022JP.NewEncoder().String("こんにちは")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := "From: =?ISO-2022-JP?B?GyRCQXc/LjxUGyhC?= <from@example.com>\r\n" +
+		"To: support@app.appspotmail.com\r\n" +
+		"Subject: =?ISO-2022-JP?B?GyRCN29MPhsoQg==?=\r\n" +
+		"Content-Type: text/plain; charset=ISO-2022-JP\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" + body + "\r\n"
+
+	m, err := ParseInboundMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From.Name != "送信者" || m.Subject != "件名" || m.Text != "こんにちは\r\n" {
+		t.Errorf("message is %+v", m)
+	}
+}
+
+func TestParseInboundMessageLenient(t *testing.T) {
+	raw := "From: =?x-unknown?Q?sender?= <from@example.com>\r\n" +
+		"To: to@example.com, broken <, =?x-unknown?Q?name?= <other@example.com>\r\n" +
+		"Subject: =?x-unknown?B?AAAA?=\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=x-unknown\r\n" +
+		"\r\n" +
+		"first\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"second\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>first</p>\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>second</p>\r\n" +
+		"--b--\r\n"
+
+	m, err := ParseInboundMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From.Name != "sender" || m.From.Email != "from@example.com" || m.Subject != "=?x-unknown?B?AAAA?=" {
+		t.Errorf("message is %+v", m)
+	}
+	if len(m.To) != 3 || m.To[0].Email != "to@example.com" || m.To[1].Email != "broken <" ||
+		m.To[2].Email != "other@example.com" || m.To[2].Name != "name" {
+		t.Errorf("to addresses are %+v", m.To)
+	}
+	if m.Text != "first\nsecond" {
+		t.Errorf("text is %q", m.Text)
+	}
+	if m.HTML != "<p>first</p>\n<p>second</p>" {
+		t.Errorf("html is %q", m.HTML)
+	}
+}
+
+func TestInboundMailHandler(t *testing.T) {
+	var got []string
+	h := NewInboundMailHandler()
+	h.Context = func(r *http.Request) context.Context { return context.Background() }
+	h.Handle("support@app.appspotmail.com", func(ctx context.Context, m *InboundMessage) error {
+		got = append(got, "full:"+m.Recipient)
+		return nil
+	})
+	h.Handle("info", func(ctx context.Context, m *InboundMessage) error {
+		got = append(got, "local:"+m.Subject)
+		return nil
+	})
+
+	raw := "From: from@example.com\r\nTo: info@app.appspotmail.com\r\nSubject: hello\r\n\r\nbody\r\n"
+	tests := []struct {
+		recipient string
+		code      int
+	}{
+		{"support@app.appspotmail.com", http.StatusOK},
+		{"Info@app.appspotmail.com", http.StatusOK},
+		{"unknown@app.appspotmail.com", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, InboundMailPath+tt.recipient, strings.NewReader(raw)))
+		if w.Code != tt.code {
+			t.Errorf("%s: status is %d, want %d", tt.recipient, w.Code, tt.code)
+		}
+	}
+	if strings.Join(got, ",") != "full:support@app.appspotmail.com,local:hello" {
+		t.Errorf("handled mails are %v", got)
+	}
+
+	h.HandleDefault(func(ctx context.Context, m *InboundMessage) error {
+		got = append(got, "default")
+		return nil
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, InboundMailPath+"unknown@app.appspotmail.com", strings.NewReader(raw)))
+	if w.Code != http.StatusOK || got[len(got)-1] != "default" {
+		t.Errorf("default route is not used, status is %d", w.Code)
+	}
+
+	n := len(got)
+	large := raw + strings.Repeat("x", maxInboundMailBody)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, InboundMailPath+"info@app.appspotmail.com", strings.NewReader(large)))
+	if w.Code != http.StatusBadRequest || len(got) != n {
+		t.Errorf("large mail status is %d, handled mails are %v", w.Code, got[n:])
+	}
+}
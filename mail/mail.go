@@ -18,16 +18,19 @@ var (
 	_ SendGridClientFactory = (*sendGridMailFactoryImpl)(nil)
 	_ GAEMailClientFactory  = (*gaeMailFactoryImpl)(nil)
 	_ GmailClientFactory    = (*gmailFactoryImpl)(nil)
+	_ SMTPClientFactory     = (*smtpMailFactoryImpl)(nil)
 
-	_ Mail = (*sendGridMailClient)(nil)
-	_ Mail = (*gaeMailClient)(nil)
-	_ Mail = (*gmailClient)(nil)
+	_ SendGridMail = (*sendGridMailClient)(nil)
+	_ Mail         = (*gaeMailClient)(nil)
+	_ Mail         = (*gmailClient)(nil)
+	_ SMTPMail     = (*smtpMailClient)(nil)
 )
 
 var (
 	sendgridmailFactory SendGridClientFactory
 	gaemailFactory      GAEMailClientFactory
 	gmailFactory        GmailClientFactory
+	smtpmailFactory     SMTPClientFactory
 )
 
 // GetSendGridMailFactory return sendgrid mail factory.
@@ -39,8 +42,12 @@ func GetSendGridMailFactory() SendGridClientFactory {
 }
 
 // Mail is mail interface.
+//
+// Send sends mail of one body to addresses without display name, it uses context given to factory.
+// SendMessage sends message with cc, bcc, attachments and so on.
 type Mail interface {
 	Send(string, string, string, string, []string) error
+	SendMessage(context.Context, *Message) error
 }
 
 // SendGridClientFactory is sendgrid client factory interface.
@@ -52,6 +59,8 @@ type SendGridClientFactory interface {
 type sendGridMailFactoryImpl struct{}
 
 // New return new send grid mail.
+//
+// Returned mail implements SendGridMail.
 func (s *sendGridMailFactoryImpl) New(ctx context.Context, client *http.Client, key string) Mail {
 	return newSendGridMail(ctx, client, key)
 }
@@ -95,5 +104,25 @@ func (g *gmailFactoryImpl) New(ctx context.Context, conf *oauth2.Config, refresh
 	if err != nil {
 		return nil, err
 	}
-	return &gmailClient{srv}, nil
+	return &gmailClient{ctx, srv}, nil
+}
+
+// SMTPClientFactory is smtp client factory interface.
+type SMTPClientFactory interface {
+	New(*SMTPConfig) SMTPMail
+}
+
+// GetSMTPMailFactory return smtp mail factory.
+func GetSMTPMailFactory() SMTPClientFactory {
+	if smtpmailFactory == nil {
+		smtpmailFactory = &smtpMailFactoryImpl{}
+	}
+	return smtpmailFactory
+}
+
+type smtpMailFactoryImpl struct{}
+
+// New return new smtp mail, connection is opened by first send.
+func (s *smtpMailFactoryImpl) New(conf *SMTPConfig) SMTPMail {
+	return newSMTPMailClient(conf)
 }
@@ -0,0 +1,148 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"strings"
+)
+
+// Address is mail address with display name.
+type Address struct {
+	Name  string
+	Email string
+}
+
+// String return address formatted for mail header, e.g. "Name" <user@example.com>.
+//
+// Non-ascii name is encoded as RFC 2047 encoded-word.
+func (a Address) String() string {
+	return (&netmail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// Attachment is file attached to message.
+type Attachment struct {
+	Filename string
+	// ContentType is mime type of data, application/octet-stream is used if it is empty.
+	ContentType string
+	Data        []byte
+	// Inline is true if attachment is shown in body, e.g. image referred by cid: url.
+	Inline bool
+	// ContentID is id referred by cid: url in html body.
+	ContentID string
+}
+
+func (a *Attachment) contentType() string {
+	if a.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return a.ContentType
+}
+
+// Message is mail message sent by Mail.
+type Message struct {
+	From    Address
+	To      []Address
+	Cc      []Address
+	Bcc     []Address
+	ReplyTo *Address
+
+	Subject string
+	// Text is text/plain body.
+	Text string
+	// HTML is text/html body, message has both parts as multipart/alternative if Text is also set.
+	HTML string
+	// AutoText generates Text from HTML if Text is empty.
+	AutoText bool
+
+	// MessageID is id of Message-ID header without angle brackets, e.g. id@example.com.
+	// Backends which build MIME generate it if it is empty.
+	MessageID string
+
+	// Headers is additional headers, some backends accept only part of them.
+	// Headers set from other fields, e.g. From and Content-Type, are not accepted.
+	Headers     map[string]string
+	Attachments []*Attachment
+}
+
+// text return text body, it is generated from html body if AutoText is set.
+func (m *Message) text() string {
+	if m.Text == "" && m.AutoText && m.HTML != "" {
+		return HTMLToText(m.HTML)
+	}
+	return m.Text
+}
+
+func (m *Message) validate() error {
+	if err := m.validateAddresses(); err != nil {
+		return err
+	}
+	if m.Text == "" && m.HTML == "" {
+		return errors.New("message has no body")
+	}
+	return nil
+}
+
+func (m *Message) validateAddresses() error {
+	if m.From.Email == "" {
+		return errors.New("from address is empty")
+	}
+	if len(m.To)+len(m.Cc)+len(m.Bcc) == 0 {
+		return errors.New("message has no recipient")
+	}
+	addrs := append([]Address{m.From}, m.To...)
+	addrs = append(addrs, m.Cc...)
+	addrs = append(addrs, m.Bcc...)
+	if m.ReplyTo != nil {
+		addrs = append(addrs, *m.ReplyTo)
+	}
+	for _, a := range addrs {
+		if err := a.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate validates that email is one addr-spec and address has no line break,
+// so that it can not inject header.
+func (a Address) validate() error {
+	if strings.ContainsAny(a.Name, "\r\n") || strings.ContainsAny(a.Email, "\r\n") {
+		return fmt.Errorf("address %q has line break", a.Email)
+	}
+	p, err := netmail.ParseAddress(a.Email)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", a.Email, err)
+	}
+	if p.Address != a.Email || p.Name != "" {
+		return fmt.Errorf("invalid address %q", a.Email)
+	}
+	return nil
+}
+
+// newSimpleMessage return message of one body to addresses without display name.
+//
+// Content is html body if content type is text/html, otherwise text body.
+func newSimpleMessage(from, subject, content, contentType string, to []string) *Message {
+	msg := &Message{
+		From:    Address{Email: from},
+		Subject: subject,
+	}
+	if contentType == "text/html" {
+		msg.HTML = content
+	} else {
+		msg.Text = content
+	}
+	for _, t := range to {
+		msg.To = append(msg.To, Address{Email: t})
+	}
+	return msg
+}
+
+func addressStrings(addrs []Address) []string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return s
+}
@@ -0,0 +1,335 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHeaderLineLen is max length of header line which RFC 5322 recommends, longer header is folded.
+	maxHeaderLineLen = 78
+	// maxLineLen is max length of line which RFC 5322 allows.
+	maxLineLen = 998
+)
+
+// reservedHeaders are headers written from fields of message, they are not accepted as additional headers.
+var reservedHeaders = map[string]bool{
+	"From":                      true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Message-Id":                true,
+}
+
+// BuildMIME return message as RFC 5322 MIME message.
+//
+// Bcc header is written only if includeBcc is true, e.g. for api which reads recipients from header.
+// Message-ID is generated if message does not have it.
+func BuildMIME(m *Message, includeBcc bool) ([]byte, error) {
+	b := &mimeBuilder{date: time.Now(), includeBcc: includeBcc}
+	return b.build(m)
+}
+
+// mimeBuilder builds MIME message, date, boundary and message id are fixed in tests.
+type mimeBuilder struct {
+	date       time.Time
+	includeBcc bool
+	// boundary return boundary of multipart, random boundary is used if it is nil.
+	boundary func() string
+	// messageID return id of message which does not have it, random id is used if it is nil.
+	messageID func(*Message) (string, error)
+}
+
+// newMessageID return random message id whose domain is domain of from address.
+func newMessageID(m *Message) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(m.From.Email, "@"); i >= 0 && i+1 < len(m.From.Email) {
+		domain = m.From.Email[i+1:]
+	}
+	return hex.EncodeToString(b) + "@" + domain, nil
+}
+
+// validateHeaderName reports error if name is not RFC 5322 field name or is written from fields of message.
+func validateHeaderName(name string) error {
+	if name == "" {
+		return errors.New("header name is empty")
+	}
+	for i := 0; i < len(name); i++ {
+		// ftext is printable ascii except colon.
+		if c := name[i]; c < 33 || c > 126 || c == ':' {
+			return fmt.Errorf("header name %q has invalid character", name)
+		}
+	}
+	if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		return fmt.Errorf("header %s is set from message fields", name)
+	}
+	return nil
+}
+
+// validateMessageID reports error if id is not dot-atom like id without angle brackets.
+func validateMessageID(id string) error {
+	if !strings.Contains(id, "@") {
+		return fmt.Errorf("message id %q has no @", id)
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c < 33 || c > 126 || c == '<' || c == '>' {
+			return fmt.Errorf("message id %q has invalid character", id)
+		}
+	}
+	return nil
+}
+
+// foldHeader return header line folded at spaces, so each line is not longer than maxHeaderLineLen if possible.
+//
+// It returns error if line is still longer than maxLineLen.
+func foldHeader(name, value string) (string, error) {
+	var buf bytes.Buffer
+	line := name + ":"
+	for _, w := range strings.Split(value, " ") {
+		// folding before empty word makes line of only white space.
+		if w != "" && len(line)+1+len(w) > maxHeaderLineLen && len(line) > len(name)+1 {
+			buf.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + w
+	}
+	buf.WriteString(line + "\r\n")
+	for _, l := range strings.Split(buf.String(), "\r\n") {
+		if len(l) > maxLineLen {
+			return "", fmt.Errorf("header %s has too long line", name)
+		}
+	}
+	return buf.String(), nil
+}
+
+// mimePart is part of MIME message.
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (b *mimeBuilder) build(m *Message) ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	for k := range m.Headers {
+		if err := validateHeaderName(k); err != nil {
+			return nil, err
+		}
+	}
+	id := m.MessageID
+	if id == "" {
+		gen := b.messageID
+		if gen == nil {
+			gen = newMessageID
+		}
+		var err error
+		if id, err = gen(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateMessageID(id); err != nil {
+		return nil, err
+	}
+	body, err := b.body(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		buf       bytes.Buffer
+		headerErr error
+	)
+	writeHeader := func(k, v string) {
+		line, err := foldHeader(k, v)
+		if err != nil {
+			headerErr = err
+			return
+		}
+		buf.WriteString(line)
+	}
+	writeHeader("From", m.From.String())
+	for _, h := range []struct {
+		name  string
+		addrs []Address
+	}{{"To", m.To}, {"Cc", m.Cc}, {"Bcc", m.Bcc}} {
+		if len(h.addrs) == 0 || (h.name == "Bcc" && !b.includeBcc) {
+			continue
+		}
+		writeHeader(h.name, strings.Join(addressStrings(h.addrs), ", "))
+	}
+	if m.ReplyTo != nil {
+		writeHeader("Reply-To", m.ReplyTo.String())
+	}
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	writeHeader("Date", b.date.Format(time.RFC1123Z))
+	writeHeader("Message-ID", "<"+id+">")
+	writeHeader("MIME-Version", "1.0")
+
+	keys := make([]string, 0, len(m.Headers))
+	for k := range m.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeHeader(textproto.CanonicalMIMEHeaderKey(k), mime.QEncoding.Encode("utf-8", m.Headers[k]))
+	}
+	for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if v := body.header.Get(k); v != "" {
+			writeHeader(k, v)
+		}
+	}
+	if headerErr != nil {
+		return nil, headerErr
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.body)
+	return buf.Bytes(), nil
+}
+
+// body return root part of message.
+//
+// Text and html are multipart/alternative, inline attachments are put with them into multipart/related,
+// and other attachments are put into multipart/mixed.
+func (b *mimeBuilder) body(m *Message) (*mimePart, error) {
+	var alternatives []*mimePart
+	if text := m.text(); text != "" {
+		p, err := textPart("text/plain", text)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, p)
+	}
+	if m.HTML != "" {
+		p, err := textPart("text/html", m.HTML)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, p)
+	}
+
+	root := alternatives[0]
+	if len(alternatives) > 1 {
+		var err error
+		if root, err = b.multipart("alternative", alternatives); err != nil {
+			return nil, err
+		}
+	}
+
+	var inline, attached []*mimePart
+	for _, a := range m.Attachments {
+		if a.Inline {
+			inline = append(inline, attachmentPart(a))
+		} else {
+			attached = append(attached, attachmentPart(a))
+		}
+	}
+	if len(inline) > 0 {
+		var err error
+		if root, err = b.multipart("related", append([]*mimePart{root}, inline...)); err != nil {
+			return nil, err
+		}
+	}
+	if len(attached) > 0 {
+		var err error
+		if root, err = b.multipart("mixed", append([]*mimePart{root}, attached...)); err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+func (b *mimeBuilder) multipart(subtype string, parts []*mimePart) (*mimePart, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if b.boundary != nil {
+		if err := w.SetBoundary(b.boundary()); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range parts {
+		pw, err := w.CreatePart(p.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": w.Boundary()}))
+	return &mimePart{h, buf.Bytes()}, nil
+}
+
+func textPart(contentType, s string) (*mimePart, error) {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"}))
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &mimePart{h, buf.Bytes()}, nil
+}
+
+func attachmentPart(a *Attachment) *mimePart {
+	disposition := "attachment"
+	if a.Inline {
+		disposition = "inline"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", a.contentType())
+	h.Set("Content-Transfer-Encoding", "base64")
+	if a.Filename != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	} else {
+		h.Set("Content-Disposition", disposition)
+	}
+	if a.ContentID != "" {
+		h.Set("Content-Id", "<"+a.ContentID+">")
+	}
+	return &mimePart{h, base64Lines(a.Data)}
+}
+
+// base64Lines return base64 of data folded at 76 characters.
+func base64Lines(data []byte) []byte {
+	const lineLen = 76
+	s := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(s) > lineLen {
+		buf.WriteString(s[:lineLen] + "\r\n")
+		s = s[lineLen:]
+	}
+	buf.WriteString(s + "\r\n")
+	return buf.Bytes()
+}
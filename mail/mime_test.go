@@ -0,0 +1,194 @@
+package mail
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	netmail "net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func newTestMIMEBuilder(includeBcc bool) *mimeBuilder {
+	var n int
+	return &mimeBuilder{
+		date:       time.Date(2017, 3, 1, 12, 0, 0, 0, time.FixedZone("JST", 9*60*60)),
+		includeBcc: includeBcc,
+		boundary: func() string {
+			n++
+			return fmt.Sprintf("boundary%d", n)
+		},
+		messageID: func(*Message) (string, error) {
+			return "test@example.com", nil
+		},
+	}
+}
+
+func TestBuildMIME(t *testing.T) {
+	from := Address{Name: "送信者", Email: "from@example.com"}
+	to := []Address{{Name: "To", Email: "to@example.com"}, {Email: "to2@example.com"}}
+	var manyTo []Address
+	for i := 0; i < 100; i++ {
+		manyTo = append(manyTo, Address{Name: fmt.Sprintf("受信者%d", i), Email: fmt.Sprintf("to%d@example.com", i)})
+	}
+
+	tests := []struct {
+		golden     string
+		m          *Message
+		includeBcc bool
+	}{
+		{
+			golden: "text.eml",
+			m: &Message{
+				From:    from,
+				To:      to,
+				Bcc:     []Address{{Email: "bcc@example.com"}},
+				Subject: "こんにちは",
+				Text:    "日本語の本文です。\nsecond line with a very long sentence which must be folded by quoted-printable encoding.",
+				Headers: map[string]string{"x-mailer": "gko"},
+			},
+		},
+		{
+			golden: "alternative.eml",
+			m: &Message{
+				From:     from,
+				To:       to,
+				Cc:       []Address{{Email: "cc@example.com"}},
+				Bcc:      []Address{{Email: "bcc@example.com"}},
+				ReplyTo:  &Address{Email: "reply@example.com"},
+				Subject:  "ascii subject",
+				HTML:     "<p>Hello <a href=\"https://example.com/\">world</a></p>",
+				AutoText: true,
+			},
+			includeBcc: true,
+		},
+		{
+			golden: "folded.eml",
+			m: &Message{
+				From:      from,
+				To:        manyTo,
+				Subject:   strings.Repeat("長い件名", 20),
+				Text:      "body",
+				MessageID: "custom@example.com",
+			},
+		},
+		{
+			golden: "attachments.eml",
+			m: &Message{
+				From:    from,
+				To:      to,
+				Subject: "attachments",
+				Text:    "see attachments",
+				HTML:    "<p>see attachments</p><img src=\"cid:logo\">",
+				Attachments: []*Attachment{
+					{Filename: "logo.png", ContentType: "image/png", Data: bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 30), Inline: true, ContentID: "logo"},
+					{Filename: "報告書.txt", ContentType: "text/plain", Data: []byte("report")},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := newTestMIMEBuilder(tt.includeBcc).build(tt.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join("testdata", tt.golden)
+		if *update {
+			if err := ioutil.WriteFile(path, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: mime is\n%s", tt.golden, got)
+		}
+		for _, l := range strings.Split(string(got), "\r\n") {
+			if len(l) > maxLineLen {
+				t.Errorf("%s: line is %d characters", tt.golden, len(l))
+			}
+		}
+	}
+}
+
+func TestBuildMIMEInvalidHeader(t *testing.T) {
+	for _, name := range []string{"", "X-Bad Name", "X-Bad:Name", "X-Bad\r\nBcc", "X-日本語", "from", "Content-Type", "message-id"} {
+		m := &Message{
+			From:    Address{Email: "from@example.com"},
+			To:      []Address{{Email: "to@example.com"}},
+			Text:    "body",
+			Headers: map[string]string{name: "value"},
+		}
+		if _, err := BuildMIME(m, false); err == nil {
+			t.Errorf("header %q is accepted", name)
+		}
+	}
+
+	m := &Message{
+		From:      Address{Email: "from@example.com"},
+		To:        []Address{{Email: "to@example.com"}},
+		Text:      "body",
+		MessageID: "id\r\nBcc: evil@example.com",
+	}
+	if _, err := BuildMIME(m, false); err == nil {
+		t.Error("invalid message id is accepted")
+	}
+}
+
+func TestBuildMIMEInvalidAddress(t *testing.T) {
+	for _, a := range []Address{
+		{Email: "to@example.com\r\nBcc: evil@example.com"},
+		{Email: "to@example.com>\r\nBcc: <evil@example.com"},
+		{Email: "to@exa\nmple.com"},
+		{Name: "Name\r\nBcc: evil@example.com", Email: "to@example.com"},
+		{Email: "Name <to@example.com>"},
+		{Email: "to@example.com, evil@example.com"},
+		{Email: "not address"},
+	} {
+		for _, m := range []*Message{
+			{From: Address{Email: "from@example.com"}, To: []Address{a}, Text: "body"},
+			{From: Address{Email: "from@example.com"}, To: []Address{{Email: "to@example.com"}}, Cc: []Address{a}, Text: "body"},
+			{From: Address{Email: "from@example.com"}, To: []Address{{Email: "to@example.com"}}, ReplyTo: &a, Text: "body"},
+			{From: a, To: []Address{{Email: "to@example.com"}}, Text: "body"},
+		} {
+			if raw, err := BuildMIME(m, false); err == nil {
+				t.Errorf("address %+v is accepted:\n%s", a, raw)
+			}
+		}
+	}
+}
+
+func TestBuildMIMEMessageID(t *testing.T) {
+	m := &Message{
+		From: Address{Email: "from@example.com"},
+		To:   []Address{{Email: "to@example.com"}},
+		Text: "body",
+	}
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		b, err := BuildMIME(m, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := netmail.ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := msg.Header.Get("Message-Id")
+		if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+			t.Errorf("message id is %s", id)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 2 {
+		t.Error("message id is not unique")
+	}
+}
@@ -1,9 +1,12 @@
 package mail
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/koichirokamoto/gko/log"
 	"github.com/sendgrid/rest"
@@ -12,6 +15,58 @@ import (
 	"golang.org/x/net/context"
 )
 
+// maxSendGridRecipients is max number of recipients in one request, it also limits number of personalizations.
+const maxSendGridRecipients = 1000
+
+// SendGridMail is mail sent through sendgrid with its specific options.
+type SendGridMail interface {
+	Mail
+	SendWithOptions(context.Context, *Message, *SendGridOptions) error
+}
+
+// SendGridOptions is sendgrid specific options of message.
+type SendGridOptions struct {
+	// TemplateID is id of dynamic template, body of message is not required if it is set.
+	TemplateID string
+	// TemplateData is dynamic template data of all recipients.
+	TemplateData map[string]interface{}
+	// RecipientData is dynamic template data keyed by email of to address, it overrides TemplateData.
+	RecipientData map[string]map[string]interface{}
+
+	Categories []string
+	CustomArgs map[string]string
+	// SendAt is time when sendgrid sends message, it is sent immediately if it is zero.
+	SendAt time.Time
+	// BatchID is batch id created by sendgrid api, it is used to cancel or pause scheduled send.
+	BatchID string
+
+	// SinglePersonalization puts to addresses into one personalization, so recipients see each other's address.
+	// Personalization is split if it has more than 1000 recipients.
+	//
+	// By default each to address has its own personalization, and cc and bcc are added to the first one.
+	SinglePersonalization bool
+}
+
+// SendGridPartialError is error of message whose requests were partly accepted by sendgrid.
+//
+// Message is split into requests of at most 1000 recipients, which are posted in order.
+// Whole message must not be retried, because recipients of sent requests receive it again.
+// Retry message whose to addresses are Unsent, cc and bcc are in the first request which has been sent.
+type SendGridPartialError struct {
+	// Sent is number of requests accepted, it is also index of failed request.
+	Sent int
+	// Total is number of requests of message.
+	Total int
+	// Unsent is to addresses of failed and following requests.
+	Unsent []Address
+	// Err is error of failed request.
+	Err error
+}
+
+func (e *SendGridPartialError) Error() string {
+	return fmt.Sprintf("sendgrid accepted %d of %d requests: %v", e.Sent, e.Total, e.Err)
+}
+
 // sendGridMailClient is mail client of sendgrid interface.
 type sendGridMailClient struct {
 	ctx    context.Context
@@ -19,29 +74,82 @@ type sendGridMailClient struct {
 	key    string
 }
 
-func newSendGridMail(ctx context.Context, client *http.Client, key string) Mail {
+func newSendGridMail(ctx context.Context, client *http.Client, key string) SendGridMail {
 	return &sendGridMailClient{ctx, client, key}
 }
 
 // Send send email using sendgrid.
 func (s *sendGridMailClient) Send(from, subject, content, contentType string, to []string) error {
+	return s.SendMessage(s.ctx, newSimpleMessage(from, subject, content, contentType, to))
+}
+
+// SendMessage send message using sendgrid.
+func (s *sendGridMailClient) SendMessage(ctx context.Context, m *Message) error {
+	return s.SendWithOptions(ctx, m, nil)
+}
+
+// SendWithOptions send email with sendgrid options.
+//
+// Message is split into requests of at most 1000 recipients.
+// If request fails after former ones are accepted, *SendGridPartialError is returned.
+func (s *sendGridMailClient) SendWithOptions(ctx context.Context, m *Message, o *SendGridOptions) error {
+	if o == nil {
+		o = &SendGridOptions{}
+	}
+	if o.TemplateID == "" {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	} else if err := m.validateAddresses(); err != nil {
+		return err
+	}
+	if len(m.To) == 0 {
+		return errors.New("sendgrid requires to address")
+	}
+	if len(m.Cc)+len(m.Bcc) >= maxSendGridRecipients {
+		return fmt.Errorf("sendgrid accepts less than %d cc and bcc addresses", maxSendGridRecipients)
+	}
+
+	mails := s.buildSendGridMails(m, o)
+	for i, sg := range mails {
+		if err := s.post(ctx, sg); err != nil {
+			if i == 0 {
+				return err
+			}
+			var unsent []Address
+			for _, sg := range mails[i:] {
+				for _, p := range sg.Personalizations {
+					for _, to := range p.To {
+						unsent = append(unsent, Address{Name: to.Name, Email: to.Address})
+					}
+				}
+			}
+			return &SendGridPartialError{Sent: i, Total: len(mails), Unsent: unsent, Err: err}
+		}
+	}
+	return nil
+}
+
+func (s *sendGridMailClient) post(ctx context.Context, sg *mail.SGMailV3) error {
 	req := sendgrid.GetRequest(s.key, endpoint, host)
 	req.Method = http.MethodPost
-	req.Body = mail.GetRequestBody(s.buildSendGridMail(from, subject, content, contentType, to))
+	req.Body = mail.GetRequestBody(sg)
 
 	httpreq, err := rest.BuildRequestObject(req)
 	if err != nil {
-		log.DefaultLogger.Log(s.ctx, log.Error, err.Error())
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
 		return err
 	}
-	res, err := s.client.Do(httpreq)
+	res, err := s.client.Do(httpreq.WithContext(ctx))
 	if err != nil {
-		log.DefaultLogger.Log(s.ctx, log.Error, err.Error())
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
 		return err
-	} else if 400 <= res.StatusCode {
+	}
+	defer res.Body.Close()
+	if 400 <= res.StatusCode {
 		msg, err := ioutil.ReadAll(res.Body)
 		if err != nil {
-			log.DefaultLogger.Log(s.ctx, log.Error, err.Error())
+			log.DefaultLogger.Log(ctx, log.Error, "%v", err)
 			return err
 		}
 		return fmt.Errorf("status code is in error range, %s", msg)
@@ -49,16 +157,124 @@ func (s *sendGridMailClient) Send(from, subject, content, contentType string, to
 	return nil
 }
 
-func (s *sendGridMailClient) buildSendGridMail(from, subject, content, contentType string, to []string) *mail.SGMailV3 {
+// buildSendGridMails return requests of message, each has at most maxSendGridRecipients recipients.
+func (s *sendGridMailClient) buildSendGridMails(m *Message, o *SendGridOptions) []*mail.SGMailV3 {
+	var (
+		mails []*mail.SGMailV3
+		sg    *mail.SGMailV3
+		n     int
+	)
+	for _, p := range newSendGridPersonalizations(m, o) {
+		r := len(p.To) + len(p.CC) + len(p.BCC)
+		if sg == nil || n+r > maxSendGridRecipients {
+			sg = s.buildSendGridMail(m, o)
+			mails = append(mails, sg)
+			n = 0
+		}
+		sg.AddPersonalizations(p)
+		n += r
+	}
+	return mails
+}
+
+// buildSendGridMail return request of message without personalizations.
+func (s *sendGridMailClient) buildSendGridMail(m *Message, o *SendGridOptions) *mail.SGMailV3 {
 	sg := mail.NewV3Mail()
-	sg.SetFrom(mail.NewEmail("", from))
-	sg.Subject = subject
-	sg.AddContent(mail.NewContent(contentType, content))
-	p := mail.NewPersonalization()
-	for _, t := range to {
-		mailto := mail.NewEmail("", t)
-		p.AddTos(mailto)
-	}
-	sg.AddPersonalizations(p)
+	sg.SetFrom(newSendGridEmail(m.From))
+	if m.ReplyTo != nil {
+		sg.SetReplyTo(newSendGridEmail(*m.ReplyTo))
+	}
+	sg.Subject = m.Subject
+	// sendgrid requires text/plain before text/html.
+	if text := m.text(); text != "" {
+		sg.AddContent(mail.NewContent("text/plain", text))
+	}
+	if m.HTML != "" {
+		sg.AddContent(mail.NewContent("text/html", m.HTML))
+	}
+	for k, v := range m.Headers {
+		sg.SetHeader(k, v)
+	}
+	for _, a := range m.Attachments {
+		att := mail.NewAttachment().
+			SetFilename(a.Filename).
+			SetType(a.contentType()).
+			SetContent(base64.StdEncoding.EncodeToString(a.Data))
+		if a.Inline {
+			att.SetDisposition("inline").SetContentID(a.ContentID)
+		} else {
+			att.SetDisposition("attachment")
+		}
+		sg.AddAttachment(att)
+	}
+
+	if o.TemplateID != "" {
+		sg.SetTemplateID(o.TemplateID)
+	}
+	sg.AddCategories(o.Categories...)
+	for k, v := range o.CustomArgs {
+		sg.SetCustomArg(k, v)
+	}
+	if !o.SendAt.IsZero() {
+		sg.SetSendAt(int(o.SendAt.Unix()))
+	}
+	if o.BatchID != "" {
+		sg.SetBatchID(o.BatchID)
+	}
 	return sg
 }
+
+func newSendGridPersonalizations(m *Message, o *SendGridOptions) []*mail.Personalization {
+	var groups [][]Address
+	if o.SinglePersonalization {
+		// the first group also has cc and bcc.
+		size := maxSendGridRecipients - len(m.Cc) - len(m.Bcc)
+		for to := m.To; len(to) > 0; size = maxSendGridRecipients {
+			if size > len(to) {
+				size = len(to)
+			}
+			groups = append(groups, to[:size])
+			to = to[size:]
+		}
+	} else {
+		groups = make([][]Address, len(m.To))
+		for i, to := range m.To {
+			groups[i] = []Address{to}
+		}
+	}
+
+	ps := make([]*mail.Personalization, len(groups))
+	for i, to := range groups {
+		p := mail.NewPersonalization()
+		p.AddTos(newSendGridEmails(to)...)
+		if i == 0 {
+			p.AddCCs(newSendGridEmails(m.Cc)...)
+			p.AddBCCs(newSendGridEmails(m.Bcc)...)
+		}
+		if o.TemplateID != "" {
+			for k, v := range o.TemplateData {
+				p.SetDynamicTemplateData(k, v)
+			}
+			// recipient data is used only if personalization has one recipient.
+			if len(to) == 1 {
+				for k, v := range o.RecipientData[to[0].Email] {
+					p.SetDynamicTemplateData(k, v)
+				}
+			}
+		}
+		ps[i] = p
+	}
+	return ps
+}
+
+func newSendGridEmail(a Address) *mail.Email {
+	return mail.NewEmail(a.Name, a.Email)
+}
+
+func newSendGridEmails(addrs []Address) []*mail.Email {
+	e := make([]*mail.Email, len(addrs))
+	for i, a := range addrs {
+		e[i] = newSendGridEmail(a)
+	}
+	return e
+}
@@ -0,0 +1,222 @@
+package mail
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"golang.org/x/net/context"
+)
+
+// newTestSendGridServer starts server which answers status returned by h and replaces sendgrid host by it.
+func newTestSendGridServer(t *testing.T, h func(body []byte) int) (*httptest.Server, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != endpoint || r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("request is %s %v", r.URL.Path, r.Header)
+		}
+		var b json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(h(b))
+	}))
+	old := host
+	host = ts.URL
+	return ts, func() {
+		host = old
+		ts.Close()
+	}
+}
+
+func TestSendGridMailSend(t *testing.T) {
+	var got struct {
+		From             *mail.Email `json:"from"`
+		Subject          string      `json:"subject"`
+		Personalizations []struct {
+			To []*mail.Email `json:"to"`
+		} `json:"personalizations"`
+		Content []*mail.Content `json:"content"`
+	}
+	ts, done := newTestSendGridServer(t, func(b []byte) int {
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Error(err)
+		}
+		return http.StatusAccepted
+	})
+	defer done()
+
+	m := GetSendGridMailFactory().New(context.Background(), ts.Client(), "key")
+	if _, ok := m.(SendGridMail); !ok {
+		t.Errorf("%T is not sendgrid mail", m)
+	}
+	if err := m.Send("from@example.com", "subject", "<p>body</p>", "text/html", []string{"to@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if got.From.Address != "from@example.com" || got.Subject != "subject" {
+		t.Errorf("mail is %+v", got)
+	}
+	if len(got.Personalizations) != 1 || len(got.Personalizations[0].To) != 1 || got.Personalizations[0].To[0].Address != "to@example.com" {
+		t.Errorf("personalizations are %+v", got.Personalizations)
+	}
+	if len(got.Content) != 1 || got.Content[0].Type != "text/html" || got.Content[0].Value != "<p>body</p>" {
+		t.Errorf("content is %+v", got.Content)
+	}
+}
+
+func TestBuildSendGridMail(t *testing.T) {
+	m := &Message{
+		From:     Address{Name: "Sender", Email: "from@example.com"},
+		To:       []Address{{Name: "To", Email: "to@example.com"}},
+		Cc:       []Address{{Email: "cc@example.com"}},
+		Bcc:      []Address{{Email: "bcc@example.com"}},
+		ReplyTo:  &Address{Email: "reply@example.com"},
+		Subject:  "subject",
+		HTML:     "<p>body</p>",
+		AutoText: true,
+		Headers:  map[string]string{"X-Test": "1"},
+		Attachments: []*Attachment{
+			{Filename: "logo.png", ContentType: "image/png", Data: []byte("png"), Inline: true, ContentID: "logo"},
+			{Filename: "a.txt", Data: []byte("text")},
+		},
+	}
+
+	var got struct {
+		From             *mail.Email `json:"from"`
+		ReplyTo          *mail.Email `json:"reply_to"`
+		Personalizations []struct {
+			To  []*mail.Email `json:"to"`
+			CC  []*mail.Email `json:"cc"`
+			BCC []*mail.Email `json:"bcc"`
+		} `json:"personalizations"`
+		Content     []*mail.Content    `json:"content"`
+		Headers     map[string]string  `json:"headers"`
+		Attachments []*mail.Attachment `json:"attachments"`
+	}
+	mails := (&sendGridMailClient{}).buildSendGridMails(m, &SendGridOptions{})
+	if len(mails) != 1 {
+		t.Fatalf("mails are %d", len(mails))
+	}
+	b := mail.GetRequestBody(mails[0])
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.From.Name != "Sender" || got.ReplyTo.Address != "reply@example.com" {
+		t.Errorf("from is %+v, reply to is %+v", got.From, got.ReplyTo)
+	}
+	if len(got.Personalizations) != 1 {
+		t.Fatalf("personalizations are %s", b)
+	}
+	p := got.Personalizations[0]
+	if len(p.To) != 1 || p.To[0].Name != "To" || len(p.CC) != 1 || len(p.BCC) != 1 {
+		t.Errorf("personalization is %s", b)
+	}
+	if len(got.Content) != 2 || got.Content[0].Type != "text/plain" || got.Content[0].Value != "body" || got.Content[1].Type != "text/html" {
+		t.Errorf("content is %s", b)
+	}
+	if got.Headers["X-Test"] != "1" {
+		t.Errorf("headers are %s", b)
+	}
+	if len(got.Attachments) != 2 {
+		t.Fatalf("attachments are %s", b)
+	}
+	inline, file := got.Attachments[0], got.Attachments[1]
+	if inline.Disposition != "inline" || inline.ContentID != "logo" || inline.Content != "cG5n" {
+		t.Errorf("inline attachment is %+v", inline)
+	}
+	if file.Disposition != "attachment" || file.Type != "application/octet-stream" {
+		t.Errorf("attachment is %+v", file)
+	}
+}
+
+func TestBuildSendGridMailsTemplate(t *testing.T) {
+	m := &Message{
+		From: Address{Email: "from@example.com"},
+		Bcc:  []Address{{Email: "bcc@example.com"}},
+	}
+	for i := 0; i < 2500; i++ {
+		m.To = append(m.To, Address{Email: fmt.Sprintf("to%d@example.com", i)})
+	}
+	o := &SendGridOptions{
+		TemplateID:    "d-template",
+		TemplateData:  map[string]interface{}{"campaign": "spring", "name": "customer"},
+		RecipientData: map[string]map[string]interface{}{"to1@example.com": {"name": "Taro"}},
+		Categories:    []string{"news"},
+		CustomArgs:    map[string]string{"id": "1"},
+		SendAt:        time.Unix(1500000000, 0),
+		BatchID:       "batch",
+	}
+
+	mails := (&sendGridMailClient{}).buildSendGridMails(m, o)
+	if len(mails) != 3 {
+		t.Fatalf("mails are %d", len(mails))
+	}
+	// the first personalization has bcc, so the first request has 999 personalizations.
+	for i, n := range []int{999, 1000, 501} {
+		sg := mails[i]
+		if len(sg.Personalizations) != n {
+			t.Errorf("mail %d has %d personalizations", i, len(sg.Personalizations))
+		}
+		if sg.TemplateID != "d-template" || sg.SendAt != 1500000000 || sg.BatchID != "batch" || sg.Categories[0] != "news" || sg.CustomArgs["id"] != "1" {
+			t.Errorf("mail %d is %s", i, mail.GetRequestBody(sg))
+		}
+	}
+
+	first, second := mails[0].Personalizations[0], mails[0].Personalizations[1]
+	if len(first.To) != 1 || len(first.BCC) != 1 || first.DynamicTemplateData["name"] != "customer" {
+		t.Errorf("first personalization is %+v", first)
+	}
+	if len(second.To) != 1 || second.To[0].Address != "to1@example.com" || len(second.BCC) != 0 {
+		t.Errorf("second personalization is %+v", second)
+	}
+	if second.DynamicTemplateData["name"] != "Taro" || second.DynamicTemplateData["campaign"] != "spring" {
+		t.Errorf("second template data is %v", second.DynamicTemplateData)
+	}
+
+	o.SinglePersonalization = true
+	mails = (&sendGridMailClient{}).buildSendGridMails(m, o)
+	if len(mails) != 3 {
+		t.Fatalf("single personalization mails are %d", len(mails))
+	}
+	for i, n := range []int{999, 1000, 501} {
+		ps := mails[i].Personalizations
+		if len(ps) != 1 || len(ps[0].To) != n {
+			t.Errorf("single personalization mail %d is %s", i, mail.GetRequestBody(mails[i]))
+		}
+	}
+	if len(mails[0].Personalizations[0].BCC) != 1 || len(mails[1].Personalizations[0].BCC) != 0 {
+		t.Errorf("bcc is not in the first personalization")
+	}
+}
+
+func TestSendGridMailSendWithOptionsPartialError(t *testing.T) {
+	var requests int
+	ts, done := newTestSendGridServer(t, func(b []byte) int {
+		requests++
+		if requests == 2 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusAccepted
+	})
+	defer done()
+
+	m := &Message{From: Address{Email: "from@example.com"}, Subject: "subject", Text: "body"}
+	for i := 0; i < 2500; i++ {
+		m.To = append(m.To, Address{Email: fmt.Sprintf("to%d@example.com", i)})
+	}
+	err := newSendGridMail(context.Background(), ts.Client(), "key").SendWithOptions(context.Background(), m, nil)
+	perr, ok := err.(*SendGridPartialError)
+	if !ok {
+		t.Fatalf("error is %v", err)
+	}
+	if perr.Sent != 1 || perr.Total != 3 || requests != 2 {
+		t.Errorf("error is %v, requests are %d", perr, requests)
+	}
+	if len(perr.Unsent) != 1500 || perr.Unsent[0].Email != "to1000@example.com" {
+		t.Errorf("unsent are %d", len(perr.Unsent))
+	}
+}
@@ -0,0 +1,267 @@
+package mail
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/koichirokamoto/gko/log"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+const (
+	// SendGridSignatureHeader is header of signature of signed event webhook.
+	SendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	// SendGridTimestampHeader is header of timestamp of signed event webhook.
+	SendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+
+	// DefaultSendGridWebhookTolerance is max difference between timestamp and now used if tolerance is not set.
+	DefaultSendGridWebhookTolerance = 10 * time.Minute
+
+	maxSendGridWebhookBody = 10 << 20
+)
+
+// SendGridEventType is type of sendgrid event.
+type SendGridEventType string
+
+// SendGrid event types.
+const (
+	SendGridProcessed        SendGridEventType = "processed"
+	SendGridDropped          SendGridEventType = "dropped"
+	SendGridDelivered        SendGridEventType = "delivered"
+	SendGridDeferred         SendGridEventType = "deferred"
+	SendGridBounce           SendGridEventType = "bounce"
+	SendGridOpen             SendGridEventType = "open"
+	SendGridClick            SendGridEventType = "click"
+	SendGridSpamReport       SendGridEventType = "spamreport"
+	SendGridUnsubscribe      SendGridEventType = "unsubscribe"
+	SendGridGroupUnsubscribe SendGridEventType = "group_unsubscribe"
+	SendGridGroupResubscribe SendGridEventType = "group_resubscribe"
+)
+
+// SendGridEvent is event posted by sendgrid event webhook.
+//
+// Fields which are not related to event type are empty.
+type SendGridEvent struct {
+	Email       string            `json:"email"`
+	Timestamp   int64             `json:"timestamp"`
+	Event       SendGridEventType `json:"event"`
+	SGEventID   string            `json:"sg_event_id"`
+	SGMessageID string            `json:"sg_message_id"`
+	SMTPID      string            `json:"smtp-id"`
+	// Category is categories of message, sendgrid posts string or array of string.
+	Category []string `json:"-"`
+
+	// Reason is reason of dropped, bounce and deferred.
+	Reason   string `json:"reason"`
+	Status   string `json:"status"`
+	Response string `json:"response"`
+	Attempt  string `json:"attempt"`
+	// Type is bounce or blocked for bounce event.
+	Type                 string `json:"type"`
+	BounceClassification string `json:"bounce_classification"`
+
+	// URL is clicked url.
+	URL        string `json:"url"`
+	UserAgent  string `json:"useragent"`
+	IP         string `json:"ip"`
+	ASMGroupID int    `json:"asm_group_id"`
+
+	// CustomArgs is custom args set by SendGridOptions, sendgrid posts them as top level fields.
+	CustomArgs map[string]interface{} `json:"-"`
+}
+
+// sendGridEventFields are fields of SendGridEvent, other fields are custom args.
+var sendGridEventFields = map[string]bool{
+	"email": true, "timestamp": true, "event": true, "sg_event_id": true, "sg_message_id": true,
+	"smtp-id": true, "category": true, "reason": true, "status": true, "response": true,
+	"attempt": true, "type": true, "bounce_classification": true, "url": true, "useragent": true,
+	"ip": true, "asm_group_id": true, "tls": true, "cert_err": true, "url_offset": true,
+	"sg_machine_open": true, "marketing_campaign_id": true, "marketing_campaign_name": true, "pool": true,
+}
+
+// UnmarshalJSON unmarshals event and collects custom args.
+func (e *SendGridEvent) UnmarshalJSON(b []byte) error {
+	type event SendGridEvent
+	if err := json.Unmarshal(b, (*event)(e)); err != nil {
+		return err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	for k, v := range all {
+		if k == "category" {
+			switch c := v.(type) {
+			case string:
+				e.Category = []string{c}
+			case []interface{}:
+				for _, s := range c {
+					if s, ok := s.(string); ok {
+						e.Category = append(e.Category, s)
+					}
+				}
+			}
+			continue
+		}
+		if sendGridEventFields[k] {
+			continue
+		}
+		if e.CustomArgs == nil {
+			e.CustomArgs = make(map[string]interface{})
+		}
+		e.CustomArgs[k] = v
+	}
+	return nil
+}
+
+// Time return time of event.
+func (e *SendGridEvent) Time() time.Time {
+	return time.Unix(e.Timestamp, 0)
+}
+
+// ParseSendGridPublicKey parses base64 verification key shown in sendgrid mail settings.
+func ParseSendGridPublicKey(s string) (*ecdsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("sendgrid verification key is not ecdsa key")
+	}
+	return key, nil
+}
+
+// VerifySendGridSignature verifies base64 signature of timestamp and body.
+func VerifySendGridSignature(key *ecdsa.PublicKey, signature, timestamp string, body []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write([]byte(timestamp))
+	h.Write(body)
+	if !ecdsa.VerifyASN1(key, h.Sum(nil), sig) {
+		return errors.New("invalid sendgrid signature")
+	}
+	return nil
+}
+
+// SendGridWebhookHandler is http handler of sendgrid signed event webhook.
+//
+// It responds 403 if signature or timestamp is invalid, and 500 if Handle returns error so that sendgrid retries.
+// Events which can not be parsed are logged and skipped, so that sendgrid does not retry whole batch for them.
+type SendGridWebhookHandler struct {
+	// PublicKey is verification key of signed event webhook, it is required.
+	PublicKey *ecdsa.PublicKey
+	// Tolerance is max difference between timestamp and now, DefaultSendGridWebhookTolerance is used if it is zero.
+	Tolerance time.Duration
+	// Handle is called with verified events.
+	Handle func(context.Context, []*SendGridEvent) error
+	// Context return context of request, appengine.NewContext is used if it is nil.
+	Context func(*http.Request) context.Context
+
+	now func() time.Time
+}
+
+// NewSendGridWebhookHandler return new sendgrid webhook handler which calls handle with verified events.
+func NewSendGridWebhookHandler(key *ecdsa.PublicKey, handle func(context.Context, []*SendGridEvent) error) (*SendGridWebhookHandler, error) {
+	if key == nil {
+		return nil, errors.New("sendgrid verification key is not set")
+	}
+	if handle == nil {
+		return nil, errors.New("sendgrid webhook handle is not set")
+	}
+	return &SendGridWebhookHandler{PublicKey: key, Handle: handle}, nil
+}
+
+func (h *SendGridWebhookHandler) context(r *http.Request) context.Context {
+	if h.Context == nil {
+		return appengine.NewContext(r)
+	}
+	return h.Context(r)
+}
+
+// ServeHTTP verifies and parses events, and calls Handle.
+func (h *SendGridWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := h.context(r)
+	if h.Handle == nil {
+		log.DefaultLogger.Log(ctx, log.Error, "sendgrid webhook handle is not set")
+		http.Error(w, "sendgrid webhook handle is not set", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSendGridWebhookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.verify(r.Header, body); err != nil {
+		log.DefaultLogger.Log(ctx, log.Warning, "%v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal(body, &raws); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events := make([]*SendGridEvent, 0, len(raws))
+	for _, raw := range raws {
+		e := &SendGridEvent{}
+		if err := json.Unmarshal(raw, e); err != nil {
+			log.DefaultLogger.Log(ctx, log.Warning, "skip sendgrid event %s: %v", raw, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	if err := h.Handle(ctx, events); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *SendGridWebhookHandler) verify(header http.Header, body []byte) error {
+	if h.PublicKey == nil {
+		return errors.New("sendgrid verification key is not set")
+	}
+	timestamp := header.Get(SendGridTimestampHeader)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid sendgrid webhook timestamp")
+	}
+
+	tolerance := h.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultSendGridWebhookTolerance
+	}
+	now := time.Now()
+	if h.now != nil {
+		now = h.now()
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return errors.New("sendgrid webhook timestamp is out of tolerance")
+	}
+	return VerifySendGridSignature(h.PublicKey, header.Get(SendGridSignatureHeader), timestamp, body)
+}
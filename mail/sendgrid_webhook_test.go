@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSendGridWebhookHandler(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParseSendGridPublicKey(base64.StdEncoding.EncodeToString(der))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	var got []*SendGridEvent
+	h, err := NewSendGridWebhookHandler(pub, func(ctx context.Context, events []*SendGridEvent) error {
+		got = events
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Context = func(r *http.Request) context.Context { return context.Background() }
+	h.now = func() time.Time { return now }
+
+	body := []byte(`[
+		{"email":"a@example.com","timestamp":1500000000,"event":"bounce","sg_event_id":"e1","reason":"550 no such user","type":"bounce","category":"news","user_id":"42"},
+		{"email":"c@example.com","timestamp":"1500000000","event":"open"},
+		{"email":"b@example.com","timestamp":1500000001,"event":"click","url":"https://example.com/","category":["news","spring"]}
+	]`)
+	sign := func(timestamp string, body []byte) string {
+		digest := sha256.Sum256(append([]byte(timestamp), body...))
+		sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		timestamp string
+		signature string
+		body      []byte
+		code      int
+	}{
+		{ts, sign(ts, body), body, http.StatusOK},
+		{ts, sign(ts, body), append(body, ' '), http.StatusForbidden},
+		{old, sign(old, body), body, http.StatusForbidden},
+		{ts, "", body, http.StatusForbidden},
+		{ts, sign(ts, []byte("{")), []byte("{"), http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		got = nil
+		r := httptest.NewRequest(http.MethodPost, "/sendgrid/events", bytes.NewReader(tt.body))
+		r.Header.Set(SendGridTimestampHeader, tt.timestamp)
+		r.Header.Set(SendGridSignatureHeader, tt.signature)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%d: status is %d, want %d", i, w.Code, tt.code)
+		}
+		if tt.code != http.StatusOK && got != nil {
+			t.Errorf("%d: events are handled", i)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/sendgrid/events", bytes.NewReader(body))
+	r.Header.Set(SendGridTimestampHeader, ts)
+	r.Header.Set(SendGridSignatureHeader, sign(ts, body))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if len(got) != 2 {
+		t.Fatalf("events are %d", len(got))
+	}
+	bounce, click := got[0], got[1]
+	if bounce.Event != SendGridBounce || bounce.Reason != "550 no such user" || !bounce.Time().Equal(now) {
+		t.Errorf("bounce event is %+v", bounce)
+	}
+	if len(bounce.Category) != 1 || bounce.CustomArgs["user_id"] != "42" || len(bounce.CustomArgs) != 1 {
+		t.Errorf("bounce categories are %v, custom args are %v", bounce.Category, bounce.CustomArgs)
+	}
+	if click.Event != SendGridClick || click.URL != "https://example.com/" || len(click.Category) != 2 || click.CustomArgs != nil {
+		t.Errorf("click event is %+v", click)
+	}
+}
+
+func TestNewSendGridWebhookHandler(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := func(ctx context.Context, events []*SendGridEvent) error { return nil }
+	if _, err := NewSendGridWebhookHandler(nil, handle); err == nil {
+		t.Error("handler without key is created")
+	}
+	if _, err := NewSendGridWebhookHandler(&priv.PublicKey, nil); err == nil {
+		t.Error("handler without handle is created")
+	}
+
+	h := &SendGridWebhookHandler{
+		PublicKey: &priv.PublicKey,
+		Context:   func(r *http.Request) context.Context { return context.Background() },
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sendgrid/events", bytes.NewReader([]byte("[]"))))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status is %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
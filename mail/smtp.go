@@ -0,0 +1,274 @@
+package mail
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koichirokamoto/gko/log"
+	"golang.org/x/net/context"
+)
+
+// DefaultSMTPTimeout is timeout of connecting and sending one message used if it is not set.
+const DefaultSMTPTimeout = 30 * time.Second
+
+// SMTPSecurity is how connection to smtp server is secured.
+type SMTPSecurity int
+
+const (
+	// SMTPStartTLS upgrades connection by STARTTLS, sending fails if server does not support it.
+	SMTPStartTLS SMTPSecurity = iota
+	// SMTPImplicitTLS connects with TLS from the beginning, e.g. port 465.
+	SMTPImplicitTLS
+	// SMTPPlain does not encrypt connection, it should be used only for local relay.
+	SMTPPlain
+)
+
+// SMTPAuthMechanism is sasl mechanism of smtp authentication.
+type SMTPAuthMechanism string
+
+// SMTP auth mechanisms.
+const (
+	SMTPAuthPlain SMTPAuthMechanism = "PLAIN"
+	SMTPAuthLogin SMTPAuthMechanism = "LOGIN"
+)
+
+// SMTPConfig is config of smtp server.
+type SMTPConfig struct {
+	// Addr is host:port of smtp server.
+	Addr     string
+	Security SMTPSecurity
+	// TLSConfig is tls config of connection, server name is host of Addr if it is not set.
+	TLSConfig *tls.Config
+
+	// Username and Password are credentials, client does not authenticate if Username is empty.
+	Username string
+	Password string
+	// AuthMechanism is SMTPAuthPlain if it is empty.
+	AuthMechanism SMTPAuthMechanism
+
+	// LocalName is host name sent by EHLO, localhost is used if it is empty.
+	LocalName string
+	// Timeout is timeout of connecting and sending one message, DefaultSMTPTimeout is used if it is zero.
+	Timeout time.Duration
+}
+
+// SMTPMail is mail sent through smtp server.
+//
+// Connection is kept and reused by following sends until Close is called.
+type SMTPMail interface {
+	Mail
+	Close() error
+}
+
+// smtpMailClient is mail client of smtp.
+type smtpMailClient struct {
+	conf *SMTPConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+	c    *smtp.Client
+}
+
+func newSMTPMailClient(conf *SMTPConfig) *smtpMailClient {
+	return &smtpMailClient{conf: conf}
+}
+
+// Send sends mail with background context, timeout of config limits it.
+func (s *smtpMailClient) Send(from, subject, content, contentType string, to []string) error {
+	return s.SendMessage(context.Background(), newSimpleMessage(from, subject, content, contentType, to))
+}
+
+// SendMessage sends message to recipients including bcc, bcc header is not written.
+func (s *smtpMailClient) SendMessage(ctx context.Context, m *Message) error {
+	raw, err := BuildMIME(m, false)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.send(ctx, m, raw); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		// state of connection is unknown after error.
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *smtpMailClient) send(ctx context.Context, m *Message, raw []byte) error {
+	timeout := s.conf.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSMTPTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if s.c != nil {
+		// connection may be closed by server while it is idle.
+		s.conn.SetDeadline(deadline)
+		if err := s.c.Reset(); err != nil {
+			s.close()
+		}
+	}
+	if s.c == nil {
+		if err := s.dial(ctx, deadline); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(deadline)
+
+	if err := s.c.Mail(m.From.Email); err != nil {
+		return err
+	}
+	for _, addrs := range [][]Address{m.To, m.Cc, m.Bcc} {
+		for _, a := range addrs {
+			if err := s.c.Rcpt(a.Email); err != nil {
+				return err
+			}
+		}
+	}
+	w, err := s.c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (s *smtpMailClient) dial(ctx context.Context, deadline time.Time) error {
+	host, _, err := net.SplitHostPort(s.conf.Addr)
+	if err != nil {
+		return err
+	}
+	d := &net.Dialer{Deadline: deadline}
+	conn, err := d.DialContext(ctx, "tcp", s.conf.Addr)
+	if err != nil {
+		return err
+	}
+	if s.conf.Security == SMTPImplicitTLS {
+		conn = tls.Client(conn, s.tlsConfig(host))
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := s.hello(c, host); err != nil {
+		c.Close()
+		return err
+	}
+	s.conn, s.c = conn, c
+	return nil
+}
+
+func (s *smtpMailClient) hello(c *smtp.Client, host string) error {
+	localName := s.conf.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err := c.Hello(localName); err != nil {
+		return err
+	}
+
+	if s.conf.Security == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := c.StartTLS(s.tlsConfig(host)); err != nil {
+			return err
+		}
+	}
+
+	if s.conf.Username == "" {
+		return nil
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("smtp server does not support AUTH")
+	}
+	var auth smtp.Auth
+	switch s.conf.AuthMechanism {
+	case "", SMTPAuthPlain:
+		auth = smtp.PlainAuth("", s.conf.Username, s.conf.Password, host)
+	case SMTPAuthLogin:
+		auth = &loginAuth{s.conf.Username, s.conf.Password, host}
+	default:
+		return errors.New("unknown smtp auth mechanism " + string(s.conf.AuthMechanism))
+	}
+	return c.Auth(auth)
+}
+
+func (s *smtpMailClient) tlsConfig(host string) *tls.Config {
+	conf := &tls.Config{}
+	if s.conf.TLSConfig != nil {
+		conf = s.conf.TLSConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+	return conf
+}
+
+// Close quits connection to smtp server.
+func (s *smtpMailClient) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.c == nil {
+		return nil
+	}
+	err := s.c.Quit()
+	s.close()
+	return err
+}
+
+func (s *smtpMailClient) close() {
+	if s.c != nil {
+		s.c.Close()
+	}
+	s.conn, s.c = nil, nil
+}
+
+// loginAuth is smtp.Auth of LOGIN mechanism.
+type loginAuth struct {
+	username, password, host string
+}
+
+// Start starts LOGIN, like smtp.PlainAuth it refuses to send credentials over unencrypted connection except localhost.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next answers username and password challenge.
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "username":
+		return []byte(a.username), nil
+	case "password:", "password":
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected LOGIN challenge " + string(fromServer))
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
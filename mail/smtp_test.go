@@ -0,0 +1,92 @@
+package mail_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koichirokamoto/gko/mail"
+	"github.com/koichirokamoto/gko/testutil"
+	"golang.org/x/net/context"
+)
+
+func newTestMessage(subject string) *mail.Message {
+	return &mail.Message{
+		From:    mail.Address{Name: "Sender", Email: "from@example.com"},
+		To:      []mail.Address{{Email: "to@example.com"}},
+		Bcc:     []mail.Address{{Email: "bcc@example.com"}},
+		Subject: subject,
+		Text:    "body",
+	}
+}
+
+func TestSMTPMail(t *testing.T) {
+	tests := []struct {
+		implicitTLS bool
+		conf        mail.SMTPConfig
+	}{
+		{false, mail.SMTPConfig{Security: mail.SMTPStartTLS, AuthMechanism: mail.SMTPAuthPlain}},
+		{true, mail.SMTPConfig{Security: mail.SMTPImplicitTLS, AuthMechanism: mail.SMTPAuthLogin}},
+	}
+	for _, tt := range tests {
+		s, err := testutil.NewFakeSMTPServer(tt.implicitTLS, "user", "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := tt.conf
+		conf.Addr = s.Addr
+		conf.TLSConfig = s.ClientTLSConfig()
+		conf.Username, conf.Password = "user", "pass"
+		conf.Timeout = 5 * time.Second
+		m := mail.GetSMTPMailFactory().New(&conf)
+
+		for _, subject := range []string{"first", "second"} {
+			if err := m.SendMessage(context.Background(), newTestMessage(subject)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+		s.Close()
+
+		if n := s.Connections(); n != 1 {
+			t.Errorf("implicit tls %v: connections are %d", tt.implicitTLS, n)
+		}
+		received := s.Received()
+		if len(received) != 2 {
+			t.Fatalf("implicit tls %v: received %d mails", tt.implicitTLS, len(received))
+		}
+		r := received[1]
+		if r.From != "from@example.com" || strings.Join(r.To, ",") != "to@example.com,bcc@example.com" {
+			t.Errorf("envelope is %s %v", r.From, r.To)
+		}
+		if !bytes.Contains(r.Data, []byte("Subject: second\n")) || bytes.Contains(r.Data, []byte("Bcc:")) {
+			t.Errorf("data is %s", r.Data)
+		}
+	}
+}
+
+func TestSMTPMailAuthFailure(t *testing.T) {
+	s, err := testutil.NewFakeSMTPServer(false, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	m := mail.GetSMTPMailFactory().New(&mail.SMTPConfig{
+		Addr:      s.Addr,
+		TLSConfig: s.ClientTLSConfig(),
+		Username:  "user",
+		Password:  "wrong",
+		Timeout:   5 * time.Second,
+	})
+	defer m.Close()
+	if err := m.SendMessage(context.Background(), newTestMessage("subject")); err == nil {
+		t.Error("mail is sent with wrong password")
+	}
+	if len(s.Received()) != 0 {
+		t.Error("server received mail")
+	}
+}
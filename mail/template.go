@@ -0,0 +1,187 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+const (
+	templateLayoutDir  = "layouts"
+	templatePartialDir = "partials"
+	subjectSuffix      = ".subject"
+)
+
+// Templates is set of mail templates parsed from file system.
+//
+// Files of layouts and partials directories are shared by all templates, html files are parsed by html/template
+// and txt files are parsed by text/template.
+// Mail template files are put on root directory and named as below, locale is optional.
+//
+//	<name>[.<locale>].subject.txt
+//	<name>[.<locale>].txt
+//	<name>[.<locale>].html
+//
+// Template uses layout by defining blocks used by layout and calling it, e.g.
+//
+//	{{define "content"}}Hello {{.Name}}{{end}}{{template "base.html" .}}
+type Templates struct {
+	subjects map[string]*texttemplate.Template
+	texts    map[string]*texttemplate.Template
+	htmls    map[string]*htmltemplate.Template
+}
+
+// ParseTemplateDir parses templates in directory of disk.
+func ParseTemplateDir(dir string, funcs map[string]interface{}) (*Templates, error) {
+	return ParseTemplates(os.DirFS(dir), funcs)
+}
+
+// ParseTemplates parses templates in file system, e.g. embed.FS.
+func ParseTemplates(fsys fs.FS, funcs map[string]interface{}) (*Templates, error) {
+	textBase := texttemplate.New("").Funcs(funcs)
+	htmlBase := htmltemplate.New("").Funcs(funcs)
+	for _, dir := range []string{templateLayoutDir, templatePartialDir} {
+		files, err := fs.Glob(fsys, dir+"/*")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			b, err := fs.ReadFile(fsys, f)
+			if err != nil {
+				return nil, err
+			}
+			switch path.Ext(f) {
+			case ".txt":
+				_, err = textBase.New(path.Base(f)).Parse(string(b))
+			case ".html":
+				_, err = htmlBase.New(path.Base(f)).Parse(string(b))
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t := &Templates{
+		subjects: make(map[string]*texttemplate.Template),
+		texts:    make(map[string]*texttemplate.Template),
+		htmls:    make(map[string]*htmltemplate.Template),
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		file := e.Name()
+		ext := path.Ext(file)
+		if ext != ".txt" && ext != ".html" {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		key := strings.TrimSuffix(file, ext)
+		switch {
+		case ext == ".txt" && strings.HasSuffix(key, subjectSuffix):
+			// subject does not use layouts.
+			tmpl, err := texttemplate.New(file).Funcs(funcs).Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+			t.subjects[strings.TrimSuffix(key, subjectSuffix)] = tmpl
+		case ext == ".txt":
+			base, err := textBase.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if t.texts[key], err = base.New(file).Parse(string(b)); err != nil {
+				return nil, err
+			}
+		default:
+			base, err := htmlBase.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if t.htmls[key], err = base.New(file).Parse(string(b)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+// localeKeys return keys of template looked up in order, e.g. name.ja-JP, name.ja and name.
+func localeKeys(name, locale string) []string {
+	var keys []string
+	for locale != "" {
+		keys = append(keys, name+"."+locale)
+		i := strings.LastIndexAny(locale, "-_")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return append(keys, name)
+}
+
+// Render renders subject and bodies of template name in locale, and return message without addresses.
+//
+// Locale falls back to less specific locale and then to template without locale.
+// The first one which has text or html body is used for all parts, so message is written in one language.
+// Text is generated from html if the template has no text body.
+// Error is returned if the template has no subject or its subject is empty, subject of other locale is not used.
+func (t *Templates) Render(name, locale string, data interface{}) (*Message, error) {
+	key := ""
+	for _, k := range localeKeys(name, locale) {
+		if t.texts[k] != nil || t.htmls[k] != nil {
+			key = k
+			break
+		}
+	}
+	if key == "" {
+		return nil, errors.New("mail template " + name + " is not found")
+	}
+
+	tmpl, ok := t.subjects[key]
+	if !ok {
+		return nil, errors.New("mail template " + key + " has no subject")
+	}
+	m := &Message{}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	// subject is one line.
+	m.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	if m.Subject == "" {
+		return nil, errors.New("subject of mail template " + key + " is empty")
+	}
+	if tmpl, ok := t.texts[key]; ok {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		m.Text = buf.String()
+	}
+	if tmpl, ok := t.htmls[key]; ok {
+		buf.Reset()
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		m.HTML = buf.String()
+	}
+	if m.Text == "" {
+		m.Text = HTMLToText(m.HTML)
+	}
+	return m, nil
+}
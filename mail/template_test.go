@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTemplatesRender(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/base.html":      {Data: []byte(`<html><body>{{template "content" .}}{{template "footer.html"}}</body></html>`)},
+		"partials/footer.html":   {Data: []byte(`<p>footer</p>`)},
+		"partials/signature.txt": {Data: []byte(`-- gko`)},
+		"welcome.subject.txt":    {Data: []byte("Welcome {{.Name}}\n")},
+		"welcome.ja.subject.txt": {Data: []byte(`ようこそ {{.Name}} さん`)},
+		"welcome.txt":            {Data: []byte(`Hello {{.Name}}{{"\n"}}{{template "signature.txt"}}`)},
+		"welcome.html":           {Data: []byte(`{{define "content"}}<p>Hello {{.Name}}</p>{{end}}{{template "base.html" .}}`)},
+		"welcome.ja.html":        {Data: []byte(`{{define "content"}}<p>こんにちは {{.Name}}</p>{{end}}{{template "base.html" .}}`)},
+		"notice.subject.txt":     {Data: []byte(`Notice`)},
+		"notice.html":            {Data: []byte(`<p>{{.Name}} &amp; co</p>`)},
+		"blank.subject.txt":      {Data: []byte("{{if false}}{{.Name}}{{end}}\n")},
+		"blank.txt":              {Data: []byte(`body`)},
+	}
+	tmpl, err := ParseTemplates(fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]string{"Name": "<Taro>"}
+
+	m, err := tmpl.Render("welcome", "en-US", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "Welcome <Taro>" || m.Text != "Hello <Taro>\n-- gko" || m.AutoText {
+		t.Errorf("en message is %+v", m)
+	}
+	if m.HTML != "<html><body><p>Hello &lt;Taro&gt;</p><p>footer</p></body></html>" {
+		t.Errorf("en html is %s", m.HTML)
+	}
+
+	m, err = tmpl.Render("welcome", "ja-JP", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// text of ja is generated from ja html instead of falling back to en text.
+	if m.Subject != "ようこそ <Taro> さん" || m.Text != HTMLToText(m.HTML) || !strings.HasPrefix(m.Text, "こんにちは <Taro>") {
+		t.Errorf("ja message is %+v", m)
+	}
+	if m.HTML != "<html><body><p>こんにちは &lt;Taro&gt;</p><p>footer</p></body></html>" {
+		t.Errorf("ja html is %s", m.HTML)
+	}
+
+	m, err = tmpl.Render("notice", "", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "Notice" || m.Text != "<Taro> & co" {
+		t.Errorf("notice message is %+v", m)
+	}
+
+	if _, err := tmpl.Render("blank", "", data); err == nil {
+		t.Error("template of empty subject is rendered")
+	}
+
+	// ja-JP falls back to welcome.ja, which has no subject, and subject of en is not mixed.
+	delete(fsys, "welcome.ja.subject.txt")
+	if tmpl, err = ParseTemplates(fsys, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := tmpl.Render("welcome", "ja-JP", data); err == nil {
+		t.Errorf("ja message without subject is rendered: %+v", m)
+	}
+
+	if _, err := tmpl.Render("unknown", "", data); err == nil {
+		t.Error("unknown template is rendered")
+	}
+}
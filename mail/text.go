@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// blockElements are elements which start new line in text.
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "div": true,
+	"footer": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "tr": true, "ul": true,
+}
+
+// skippedElements are elements whose content is not shown as text.
+var skippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true,
+}
+
+// HTMLToText return plain text of html body.
+//
+// Block elements are separated by line, link url is written after its text and list item starts with "- ".
+func HTMLToText(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	var (
+		b     strings.Builder
+		line  strings.Builder
+		skip  int
+		hrefs []string
+	)
+	flush := func() {
+		l := strings.Join(strings.Fields(line.String()), " ")
+		line.Reset()
+		if l != "" {
+			b.WriteString(l)
+			b.WriteByte('\n')
+		}
+	}
+	paragraph := func() {
+		flush()
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n\n") {
+			b.WriteByte('\n')
+		}
+	}
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			flush()
+			return strings.TrimSpace(b.String())
+		case html.TextToken:
+			if skip == 0 {
+				line.Write(z.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			if skippedElements[tag] {
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+				continue
+			}
+			if skip > 0 {
+				continue
+			}
+
+			switch {
+			case tag == "br":
+				flush()
+			case tag == "a" && tt == html.StartTagToken:
+				var href string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					if string(k) == "href" {
+						href = string(v)
+					}
+				}
+				hrefs = append(hrefs, href)
+			case tag == "a" && tt == html.EndTagToken:
+				if len(hrefs) == 0 {
+					continue
+				}
+				href := hrefs[len(hrefs)-1]
+				hrefs = hrefs[:len(hrefs)-1]
+				if href != "" && !strings.HasPrefix(href, "#") && !strings.Contains(line.String(), href) {
+					line.WriteString(" (" + href + ")")
+				}
+			case tag == "li" && tt == html.StartTagToken:
+				flush()
+				line.WriteString("- ")
+			case tag == "td" || tag == "th":
+				line.WriteByte(' ')
+			case blockElements[tag]:
+				if tag == "li" || tag == "tr" {
+					flush()
+				} else {
+					paragraph()
+				}
+			}
+		}
+	}
+}
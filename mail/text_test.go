@@ -0,0 +1,22 @@
+package mail
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"<p>Hello,   <b>world</b></p><p>second</p>", "Hello, world\n\nsecond"},
+		{"line1<br>line2", "line1\nline2"},
+		{`<p>see <a href="https://example.com/">site</a></p>`, "see site (https://example.com/)"},
+		{`<a href="https://example.com/">https://example.com/</a>`, "https://example.com/"},
+		{"<ul><li>one</li><li>two</li></ul>", "- one\n- two"},
+		{"<html><head><title>t</title><style>p{}</style></head><body><script>x()</script>body &amp; text</body></html>", "body & text"},
+	}
+	for _, tt := range tests {
+		if got := HTMLToText(tt.html); got != tt.want {
+			t.Errorf("%s: text is %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
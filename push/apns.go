@@ -0,0 +1,215 @@
+package push
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/koichirokamoto/gko/log"
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/token"
+	"golang.org/x/net/context"
+)
+
+type apnsWorker struct {
+	c           *apns2.Client
+	deviceToken string
+	payload     []byte
+	headers     *ApnsHeaders
+	res         *Result
+}
+
+// SendApns2Notification send apns2 notification.
+//
+// Returned report contains delivery result of each device token.
+func SendApns2Notification(ctx context.Context, cert tls.Certificate, deviceTokens []string, payload []byte, opts ...Option) *Report {
+	return NewApnsClient(cert).Send(ctx, deviceTokens, payload, opts...)
+}
+
+// ApnsClient is client of apns.
+type ApnsClient struct {
+	c *apns2.Client
+}
+
+// NewApnsClient return new apns client authenticated by certificate.
+func NewApnsClient(cert tls.Certificate) *ApnsClient {
+	return newApnsClient(apns2.NewClient(cert))
+}
+
+// newApnsClient return apns client which sends with copy of c.
+//
+// Transport of copied http client records Retry-After header, which apns2 response does not have.
+func newApnsClient(c *apns2.Client) *ApnsClient {
+	cc := *c
+	hc := http.Client{}
+	if c.HTTPClient != nil {
+		hc = *c.HTTPClient
+	}
+	hc.Transport = &retryAfterTransport{hc.Transport}
+	cc.HTTPClient = &hc
+	return &ApnsClient{&cc}
+}
+
+// retryAfterKey is context key of pointer to which retryAfterTransport writes Retry-After header.
+type retryAfterKey struct{}
+
+// retryAfterTransport writes Retry-After header of response to string pointer in context of request.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := req.Context().Value(retryAfterKey{}).(*string); ok {
+		*v = res.Header.Get("Retry-After")
+	}
+	return res, nil
+}
+
+// CloseIdleConnections closes idle connections of base transport, it is called by apns2 client.
+func (t *retryAfterTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// NewApnsTokenClient return new apns client authenticated by auth key.
+//
+// authKey is content of .p8 file downloaded from apple developer account.
+// Provider token signed by auth key is cached and refreshed before it expires.
+func NewApnsTokenClient(authKey []byte, keyID, teamID string) (*ApnsClient, error) {
+	key, err := token.AuthKeyFromBytes(authKey)
+	if err != nil {
+		return nil, err
+	}
+	t := &token.Token{
+		AuthKey: key,
+		KeyID:   keyID,
+		TeamID:  teamID,
+	}
+	return newApnsClient(apns2.NewTokenClient(t)), nil
+}
+
+// NewApnsClientFromApns2 return apns client which sends with apns2 client.
+//
+// Client is copied, so changing host of c does not affect returned client. Token is shared.
+func NewApnsClientFromApns2(c *apns2.Client) *ApnsClient {
+	return newApnsClient(c)
+}
+
+// Development set host of client to apns development server.
+func (a *ApnsClient) Development() *ApnsClient {
+	a.c.Development()
+	return a
+}
+
+// Production set host of client to apns production server.
+func (a *ApnsClient) Production() *ApnsClient {
+	a.c.Production()
+	return a
+}
+
+// Send sends payload to each device token.
+//
+// Returned report contains delivery result of each device token.
+func (a *ApnsClient) Send(ctx context.Context, deviceTokens []string, payload []byte, opts ...Option) *Report {
+	return a.send(ctx, deviceTokens, payload, nil, opts)
+}
+
+func (a *ApnsClient) send(ctx context.Context, deviceTokens []string, payload []byte, h *ApnsHeaders, opts []Option) *Report {
+	wrk := make([]worker, len(deviceTokens))
+	for i, d := range deviceTokens {
+		wrk[i] = &apnsWorker{a.c, d, payload, h, &Result{DeviceToken: d}}
+	}
+
+	return runWorker(ctx, wrk, newOptions(opts))
+}
+
+func (a *apnsWorker) result() *Result {
+	return a.res
+}
+
+func (a *apnsWorker) platform() Platform {
+	return PlatformApns
+}
+
+func (a *apnsWorker) host() string {
+	u, err := url.Parse(a.c.Host)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (a *apnsWorker) work(ctx context.Context) error {
+	a.res.Attempts++
+	notification := &apns2.Notification{}
+	notification.DeviceToken = a.deviceToken
+	notification.Payload = a.payload
+	if a.headers != nil {
+		a.headers.apply(notification)
+	}
+
+	bearer := a.bearer()
+	var retryAfter string
+	res, err := a.c.PushWithContext(context.WithValue(ctx, retryAfterKey{}, &retryAfter), notification)
+	if err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		return err
+	}
+
+	a.res.StatusCode = res.StatusCode
+	a.res.Reason = res.Reason
+	a.res.Timestamp = res.Timestamp.Time
+	if !res.Sent() {
+		errMsg := fmt.Sprintf("not sent: %d %s %s", res.StatusCode, res.ApnsID, res.Reason)
+		log.DefaultLogger.Log(ctx, log.Error, "%s", errMsg)
+		a.res.Invalid = isInvalidDeviceTokenReason(res.Reason)
+		retryable := isRetryableStatus(res.StatusCode)
+		if res.Reason == apns2.ReasonExpiredProviderToken && a.c.Token != nil {
+			// regenerate provider token and retry with it.
+			if err := a.refreshToken(bearer); err != nil {
+				log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+			} else {
+				retryable = true
+			}
+		}
+		return &sendError{msg: errMsg, retryable: retryable, retryAfter: parseRetryAfter(retryAfter)}
+	}
+
+	a.res.Sent = true
+	return nil
+}
+
+// bearer return provider token which will be sent, it is empty if client uses certificate.
+func (a *apnsWorker) bearer() string {
+	if a.c.Token == nil {
+		return ""
+	}
+	return a.c.Token.GenerateIfExpired()
+}
+
+// refreshToken regenerates provider token rejected as expired.
+//
+// Workers sharing the token get the same error at once, so token is regenerated
+// only if it is still the one worker sent; others retry with token already regenerated.
+// Apns answers TooManyProviderTokenUpdates if token is updated too often.
+// Bearer is compared instead of IssuedAt because IssuedAt has only second precision.
+func (a *apnsWorker) refreshToken(bearer string) error {
+	t := a.c.Token
+	t.Lock()
+	defer t.Unlock()
+	if t.Bearer != bearer {
+		return nil
+	}
+	_, err := t.Generate()
+	return err
+}
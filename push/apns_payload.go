@@ -0,0 +1,169 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/context"
+)
+
+const (
+	// MaxApnsPayloadSize is max size of apns payload.
+	MaxApnsPayloadSize = 4096
+	// MaxApnsVoIPPayloadSize is max size of apns voip payload.
+	MaxApnsVoIPPayloadSize = 5120
+
+	maxApnsCollapseIDSize = 64
+)
+
+// ApnsPushType is value of apns-push-type header.
+type ApnsPushType string
+
+// Push types of apns.
+const (
+	ApnsPushTypeAlert        ApnsPushType = "alert"
+	ApnsPushTypeBackground   ApnsPushType = "background"
+	ApnsPushTypeVoIP         ApnsPushType = "voip"
+	ApnsPushTypeComplication ApnsPushType = "complication"
+	ApnsPushTypeFileProvider ApnsPushType = "fileprovider"
+	ApnsPushTypeMDM          ApnsPushType = "mdm"
+)
+
+// Priorities of apns.
+const (
+	ApnsPriorityLow  = apns2.PriorityLow
+	ApnsPriorityHigh = apns2.PriorityHigh
+)
+
+// ApnsPayload is payload of apns notification.
+type ApnsPayload struct {
+	Alert *ApnsAlert
+	// Badge is number shown on app icon, 0 removes badge and nil leaves it unchanged.
+	Badge            *int
+	Sound            string
+	Category         string
+	ThreadID         string
+	MutableContent   bool
+	ContentAvailable bool
+
+	// Data is custom data put at top level of payload beside aps.
+	Data map[string]interface{}
+}
+
+// ApnsAlert is alert of apns notification.
+type ApnsAlert struct {
+	Title           string   `json:"title,omitempty"`
+	Subtitle        string   `json:"subtitle,omitempty"`
+	Body            string   `json:"body,omitempty"`
+	TitleLocKey     string   `json:"title-loc-key,omitempty"`
+	TitleLocArgs    []string `json:"title-loc-args,omitempty"`
+	SubtitleLocKey  string   `json:"subtitle-loc-key,omitempty"`
+	SubtitleLocArgs []string `json:"subtitle-loc-args,omitempty"`
+	LocKey          string   `json:"loc-key,omitempty"`
+	LocArgs         []string `json:"loc-args,omitempty"`
+	ActionLocKey    string   `json:"action-loc-key,omitempty"`
+	LaunchImage     string   `json:"launch-image,omitempty"`
+}
+
+type aps struct {
+	Alert            *ApnsAlert `json:"alert,omitempty"`
+	Badge            *int       `json:"badge,omitempty"`
+	Sound            string     `json:"sound,omitempty"`
+	Category         string     `json:"category,omitempty"`
+	ThreadID         string     `json:"thread-id,omitempty"`
+	MutableContent   int        `json:"mutable-content,omitempty"`
+	ContentAvailable int        `json:"content-available,omitempty"`
+}
+
+// MarshalJSON marshals payload to apns json format.
+func (p *ApnsPayload) MarshalJSON() ([]byte, error) {
+	a := &aps{
+		Alert:    p.Alert,
+		Badge:    p.Badge,
+		Sound:    p.Sound,
+		Category: p.Category,
+		ThreadID: p.ThreadID,
+	}
+	if p.MutableContent {
+		a.MutableContent = 1
+	}
+	if p.ContentAvailable {
+		a.ContentAvailable = 1
+	}
+
+	m := make(map[string]interface{}, len(p.Data)+1)
+	for k, v := range p.Data {
+		if k == "aps" {
+			return nil, errors.New("custom data must not have aps key")
+		}
+		m[k] = v
+	}
+	m["aps"] = a
+	return json.Marshal(m)
+}
+
+// ApnsHeaders is request headers of apns notification.
+type ApnsHeaders struct {
+	// Topic is bundle id of app, it is required with token authentication.
+	Topic string
+	// Priority is ApnsPriorityHigh or ApnsPriorityLow, apns uses high if it is zero.
+	Priority int
+	// Expiration is time until apns retries delivery.
+	//
+	// Header is not sent if it is zero, and apns stores notification by its default policy.
+	// Set past time, e.g. time.Unix(1, 0), to deliver only once without storing notification.
+	// Unix epoch is not sent as apns2 omits header of time not after it.
+	Expiration time.Time
+	// CollapseID is id to replace notification shown on device, it must not be longer than 64 bytes.
+	CollapseID string
+	PushType   ApnsPushType
+}
+
+func (h *ApnsHeaders) validate() error {
+	if h.Priority != 0 && h.Priority != ApnsPriorityLow && h.Priority != ApnsPriorityHigh {
+		return fmt.Errorf("apns priority must be %d or %d", ApnsPriorityLow, ApnsPriorityHigh)
+	}
+	if len(h.CollapseID) > maxApnsCollapseIDSize {
+		return fmt.Errorf("apns collapse id must not be longer than %d bytes", maxApnsCollapseIDSize)
+	}
+	return nil
+}
+
+func (h *ApnsHeaders) maxPayloadSize() int {
+	if h.PushType == ApnsPushTypeVoIP {
+		return MaxApnsVoIPPayloadSize
+	}
+	return MaxApnsPayloadSize
+}
+
+func (h *ApnsHeaders) apply(n *apns2.Notification) {
+	n.Topic = h.Topic
+	n.Priority = h.Priority
+	n.Expiration = h.Expiration
+	n.CollapseID = h.CollapseID
+	n.PushType = apns2.EPushType(h.PushType)
+}
+
+// SendNotification sends typed payload with headers to each device token.
+//
+// Error is returned without sending if payload or headers are invalid.
+func (a *ApnsClient) SendNotification(ctx context.Context, deviceTokens []string, p *ApnsPayload, h *ApnsHeaders, opts ...Option) (*Report, error) {
+	if h == nil {
+		h = &ApnsHeaders{}
+	}
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if max := h.maxPayloadSize(); len(payload) > max {
+		return nil, fmt.Errorf("apns payload is %d bytes, it must not be larger than %d bytes", len(payload), max)
+	}
+
+	return a.send(ctx, deviceTokens, payload, h, opts), nil
+}
@@ -0,0 +1,121 @@
+package push_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koichirokamoto/gko/push"
+	"github.com/koichirokamoto/gko/testutil"
+	"golang.org/x/net/context"
+)
+
+func TestApnsPayloadMarshalJSON(t *testing.T) {
+	zero := 0
+	tests := []struct {
+		name    string
+		p       *push.ApnsPayload
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			p:    &push.ApnsPayload{},
+			want: `{"aps":{}}`,
+		},
+		{
+			name: "alert",
+			p: &push.ApnsPayload{
+				Alert:    &push.ApnsAlert{Title: "title", Body: "body", LocArgs: []string{"a"}},
+				Sound:    "default",
+				Category: "message",
+				ThreadID: "thread",
+			},
+			want: `{"aps":{"alert":{"title":"title","body":"body","loc-args":["a"]},"sound":"default","category":"message","thread-id":"thread"}}`,
+		},
+		{
+			name: "zero badge",
+			p:    &push.ApnsPayload{Badge: &zero},
+			want: `{"aps":{"badge":0}}`,
+		},
+		{
+			name: "flags and data",
+			p:    &push.ApnsPayload{MutableContent: true, ContentAvailable: true, Data: map[string]interface{}{"id": 1}},
+			want: `{"aps":{"mutable-content":1,"content-available":1},"id":1}`,
+		},
+		{
+			name:    "aps in data",
+			p:       &push.ApnsPayload{Data: map[string]interface{}{"aps": 1}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.p)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: error is nil", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s: payload is %s", tt.name, b)
+		}
+	}
+}
+
+func TestApnsClientSendNotificationValidation(t *testing.T) {
+	s := testutil.NewFakeApnsServer()
+	defer s.Close()
+	c := push.NewApnsClientFromApns2(s.Apns2Client())
+
+	// payloadOfSize return payload whose json is n bytes, {"aps":{},"d":""} is 17 bytes.
+	payloadOfSize := func(n int) *push.ApnsPayload {
+		return &push.ApnsPayload{Data: map[string]interface{}{"d": strings.Repeat("a", n-17)}}
+	}
+	tests := []struct {
+		name    string
+		p       *push.ApnsPayload
+		h       *push.ApnsHeaders
+		wantErr bool
+	}{
+		{"nil headers", payloadOfSize(100), nil, false},
+		{"low priority", payloadOfSize(100), &push.ApnsHeaders{Priority: push.ApnsPriorityLow}, false},
+		{"invalid priority", payloadOfSize(100), &push.ApnsHeaders{Priority: 1}, true},
+		{"collapse id of 64 bytes", payloadOfSize(100), &push.ApnsHeaders{CollapseID: strings.Repeat("a", 64)}, false},
+		{"collapse id of 65 bytes", payloadOfSize(100), &push.ApnsHeaders{CollapseID: strings.Repeat("a", 65)}, true},
+		{"4KB payload", payloadOfSize(push.MaxApnsPayloadSize), nil, false},
+		{"payload over 4KB", payloadOfSize(push.MaxApnsPayloadSize + 1), nil, true},
+		{"5KB voip payload", payloadOfSize(push.MaxApnsVoIPPayloadSize), &push.ApnsHeaders{PushType: push.ApnsPushTypeVoIP}, false},
+		{"voip payload over 5KB", payloadOfSize(push.MaxApnsVoIPPayloadSize + 1), &push.ApnsHeaders{PushType: push.ApnsPushTypeVoIP}, true},
+		{"no store", payloadOfSize(100), &push.ApnsHeaders{Expiration: time.Unix(1, 0)}, false},
+	}
+	for _, tt := range tests {
+		report, err := c.SendNotification(context.Background(), []string{"token"}, tt.p, tt.h)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: error is nil", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if report.SuccessCount() != 1 {
+			t.Errorf("%s: result is %+v", tt.name, report.Results[0])
+		}
+	}
+
+	received := s.Received()
+	if last := received[len(received)-1]; last.Header.Get("apns-expiration") != "1" {
+		t.Errorf("expiration header is %q", last.Header.Get("apns-expiration"))
+	}
+	if first := received[0]; first.Header.Get("apns-expiration") != "" {
+		t.Errorf("expiration header of zero is %q", first.Header.Get("apns-expiration"))
+	}
+}
@@ -0,0 +1,154 @@
+package push_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koichirokamoto/gko/push"
+	"github.com/koichirokamoto/gko/testutil"
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/token"
+	"golang.org/x/net/context"
+)
+
+var fastRetry = &push.RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 1}
+
+func TestApnsClientRefreshExpiredToken(t *testing.T) {
+	s := testutil.NewFakeApnsServer()
+	defer s.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := &token.Token{AuthKey: key, KeyID: "key", TeamID: "team"}
+	expired := tk.GenerateIfExpired()
+	s.ExpireProviderToken(expired)
+
+	c := s.Apns2Client()
+	c.Token = tk
+	deviceTokens := make([]string, 50)
+	for i := range deviceTokens {
+		deviceTokens[i] = "device" + strconv.Itoa(i)
+	}
+	report := push.NewApnsClientFromApns2(c).Send(context.Background(), deviceTokens, []byte(`{"aps":{}}`), push.WithMaxConcurrency(len(deviceTokens)), push.WithRetryPolicy(fastRetry))
+
+	if n := report.SuccessCount(); n != len(deviceTokens) {
+		t.Errorf("success count is %d", n)
+	}
+	bearers := make(map[string]bool)
+	for _, r := range s.Received() {
+		bearers[r.Header.Get("Authorization")] = true
+	}
+	if len(bearers) != 1 || bearers["bearer "+expired] {
+		t.Errorf("token is regenerated %d times", len(bearers))
+	}
+}
+
+type recordingInvalidHandler struct {
+	mu     sync.Mutex
+	subs   []*push.FcmSubscription
+	tokens []string
+}
+
+func (h *recordingInvalidHandler) InvalidSubscription(ctx context.Context, sub *push.FcmSubscription) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs = append(h.subs, sub)
+	return nil
+}
+
+func (h *recordingInvalidHandler) InvalidDeviceToken(ctx context.Context, token string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens = append(h.tokens, token)
+	return nil
+}
+
+func TestApnsClientSendNotification(t *testing.T) {
+	s := testutil.NewFakeApnsServer()
+	defer s.Close()
+	s.InjectError("bad", http.StatusBadRequest, apns2.ReasonBadDeviceToken, -1)
+
+	badge := 1
+	p := &push.ApnsPayload{
+		Alert: &push.ApnsAlert{Title: "title", Body: "body"},
+		Badge: &badge,
+		Data:  map[string]interface{}{"id": "1"},
+	}
+	h := &push.ApnsHeaders{Topic: "com.example.app", Priority: push.ApnsPriorityHigh, CollapseID: "news", PushType: push.ApnsPushTypeAlert}
+	invalid := &recordingInvalidHandler{}
+	report, err := push.NewApnsClientFromApns2(s.Apns2Client()).SendNotification(context.Background(), []string{"good", "bad"}, p, h,
+		push.WithInvalidRecipientHandler(invalid), push.WithRetryPolicy(fastRetry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := report.Results[0]; !res.Sent || res.StatusCode != http.StatusOK || res.Attempts != 1 {
+		t.Errorf("result of good token is %+v", res)
+	}
+	if res := report.Results[1]; res.Sent || !res.Invalid || res.Reason != apns2.ReasonBadDeviceToken || res.Attempts != 1 {
+		t.Errorf("result of bad token is %+v", res)
+	}
+	if len(invalid.tokens) != 1 || invalid.tokens[0] != "bad" {
+		t.Errorf("invalid tokens are %v", invalid.tokens)
+	}
+
+	received := s.Received()
+	if len(received) != 1 {
+		t.Fatalf("received %d notifications", len(received))
+	}
+	r := received[0]
+	if r.DeviceToken != "good" || r.Header.Get("apns-topic") != "com.example.app" || r.Header.Get("apns-priority") != "10" ||
+		r.Header.Get("apns-collapse-id") != "news" || r.Header.Get("apns-push-type") != "alert" {
+		t.Errorf("notification is %s %v", r.DeviceToken, r.Header)
+	}
+	var got struct {
+		Aps struct {
+			Alert push.ApnsAlert `json:"alert"`
+			Badge int            `json:"badge"`
+		} `json:"aps"`
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(r.Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Aps.Alert.Title != "title" || got.Aps.Badge != 1 || got.ID != "1" {
+		t.Errorf("payload is %s", r.Payload)
+	}
+}
+
+func TestApnsClientSendRetry(t *testing.T) {
+	s := testutil.NewFakeApnsServer()
+	defer s.Close()
+	s.InjectRetryAfter("throttled", http.StatusTooManyRequests, apns2.ReasonTooManyRequests, 1, 1)
+	s.InjectError("unavailable", http.StatusServiceUnavailable, apns2.ReasonServiceUnavailable, 2)
+	s.InjectError("down", http.StatusServiceUnavailable, apns2.ReasonServiceUnavailable, -1)
+
+	start := time.Now()
+	report := push.NewApnsClientFromApns2(s.Apns2Client()).Send(context.Background(), []string{"throttled", "unavailable", "down"}, []byte(`{"aps":{}}`),
+		push.WithRetryPolicy(fastRetry))
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retry after is not respected, send took %s", d)
+	}
+
+	if res := report.Results[0]; !res.Sent || res.Attempts != 2 {
+		t.Errorf("result of throttled token is %+v", res)
+	}
+	if res := report.Results[1]; !res.Sent || res.Attempts != 3 {
+		t.Errorf("result of unavailable token is %+v", res)
+	}
+	if res := report.Results[2]; res.Sent || res.Err == nil || res.Attempts != fastRetry.MaxAttempts || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("result of down token is %+v", res)
+	}
+	if n := len(s.Received()); n != 2 {
+		t.Errorf("received %d notifications", n)
+	}
+}
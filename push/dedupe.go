@@ -0,0 +1,187 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	// DefaultDedupeExpiration is how long sent recipient is remembered if expiration is not set.
+	DefaultDedupeExpiration = 24 * time.Hour
+	// DefaultDedupePendingExpiration is how long claimed recipient is remembered until it is sent,
+	// if pending expiration is not set. It must be longer than send to one recipient including retries.
+	DefaultDedupePendingExpiration = 5 * time.Minute
+
+	// memoryDedupeSweepInterval is interval of removing expired keys from memory.
+	memoryDedupeSweepInterval = time.Minute
+)
+
+var (
+	_ DedupeStore = (*MemcacheDedupeStore)(nil)
+	_ DedupeStore = (*MemoryDedupeStore)(nil)
+)
+
+// DedupeStore records recipients sent with idempotency key.
+//
+// Key is claimed with pending expiration before send, and confirmed with full expiration after send.
+// If process dies between claim and send, recipient is skipped until pending expiration passes,
+// so replay after it delivers the notification.
+type DedupeStore interface {
+	// Claim records key atomically for pending expiration, it reports false if key is already recorded.
+	Claim(ctx context.Context, key string) (bool, error)
+	// Confirm extends key claimed by recipient which was sent to full expiration.
+	Confirm(ctx context.Context, key string) error
+	// Release removes key claimed by recipient which was not sent.
+	Release(ctx context.Context, key string) error
+}
+
+// dedupeKey return key of recipient of result sent with idempotency key.
+//
+// It is hashed to fit in memcache key length.
+func dedupeKey(idempotencyKey string, res *Result) string {
+	recipient := res.DeviceToken
+	if res.Subscription != nil {
+		recipient = res.Subscription.Endpoint
+	}
+	h := sha256.Sum256([]byte(idempotencyKey + "\x00" + recipient))
+	return "push:sent:" + hex.EncodeToString(h[:])
+}
+
+// memcacheClient is memcache operations used by MemcacheDedupeStore.
+type memcacheClient interface {
+	Add(ctx context.Context, item *memcache.Item) error
+	Set(ctx context.Context, item *memcache.Item) error
+	Delete(ctx context.Context, key string) error
+}
+
+// appengineMemcache is app engine memcache.
+type appengineMemcache struct{}
+
+func (appengineMemcache) Add(ctx context.Context, item *memcache.Item) error {
+	return memcache.Add(ctx, item)
+}
+
+func (appengineMemcache) Set(ctx context.Context, item *memcache.Item) error {
+	return memcache.Set(ctx, item)
+}
+
+func (appengineMemcache) Delete(ctx context.Context, key string) error {
+	return memcache.Delete(ctx, key)
+}
+
+// MemcacheDedupeStore records keys in app engine memcache.
+//
+// Memcache may evict keys before expiration, so duplicates are reduced but not eliminated.
+type MemcacheDedupeStore struct {
+	// Expiration is how long sent key is recorded, DefaultDedupeExpiration is used if it is zero.
+	Expiration time.Duration
+	// PendingExpiration is how long claimed key is recorded until it is sent,
+	// DefaultDedupePendingExpiration is used if it is zero.
+	PendingExpiration time.Duration
+
+	client memcacheClient
+}
+
+func (m *MemcacheDedupeStore) cache() memcacheClient {
+	if m.client == nil {
+		return appengineMemcache{}
+	}
+	return m.client
+}
+
+// Claim adds key to memcache, it reports false if key is already in memcache.
+func (m *MemcacheDedupeStore) Claim(ctx context.Context, key string) (bool, error) {
+	exp := m.PendingExpiration
+	if exp <= 0 {
+		exp = DefaultDedupePendingExpiration
+	}
+	err := m.cache().Add(ctx, &memcache.Item{Key: key, Value: []byte{1}, Expiration: exp})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Confirm sets key to memcache again with full expiration.
+func (m *MemcacheDedupeStore) Confirm(ctx context.Context, key string) error {
+	exp := m.Expiration
+	if exp <= 0 {
+		exp = DefaultDedupeExpiration
+	}
+	return m.cache().Set(ctx, &memcache.Item{Key: key, Value: []byte{1}, Expiration: exp})
+}
+
+// Release deletes key from memcache.
+func (m *MemcacheDedupeStore) Release(ctx context.Context, key string) error {
+	if err := m.cache().Delete(ctx, key); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// MemoryDedupeStore records keys in memory of process.
+//
+// Claimed key is recorded for DefaultDedupePendingExpiration until it is confirmed.
+type MemoryDedupeStore struct {
+	expiration time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]time.Time
+	sweepAt time.Time
+}
+
+// NewMemoryDedupeStore return new in-memory store which records key for expiration.
+//
+// DefaultDedupeExpiration is used if expiration is zero.
+func NewMemoryDedupeStore(expiration time.Duration) *MemoryDedupeStore {
+	if expiration <= 0 {
+		expiration = DefaultDedupeExpiration
+	}
+	return &MemoryDedupeStore{expiration: expiration, keys: make(map[string]time.Time)}
+}
+
+// Claim records key unless it is recorded and not expired.
+//
+// Expired keys are removed at most once per memoryDedupeSweepInterval, so claim is not slowed by number of keys.
+func (m *MemoryDedupeStore) Claim(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.After(m.sweepAt) {
+		for k, exp := range m.keys {
+			if now.After(exp) {
+				delete(m.keys, k)
+			}
+		}
+		m.sweepAt = now.Add(memoryDedupeSweepInterval)
+	}
+	if exp, ok := m.keys[key]; ok && !now.After(exp) {
+		return false, nil
+	}
+	m.keys[key] = now.Add(DefaultDedupePendingExpiration)
+	return true, nil
+}
+
+// Confirm records key for expiration.
+func (m *MemoryDedupeStore) Confirm(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key] = time.Now().Add(m.expiration)
+	return nil
+}
+
+// Release removes key.
+func (m *MemoryDedupeStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, key)
+	return nil
+}
@@ -0,0 +1,223 @@
+package push
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestSendTokensIdempotencyKey(t *testing.T) {
+	var requests int32
+	c, done := newTestFcmClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"name":"projects/test-project/messages/1"}`))
+	})
+	defer done()
+
+	store := NewMemoryDedupeStore(0)
+	m := &Message{Data: map[string]string{"k": "v"}}
+	tokens := []string{"a", "b"}
+
+	report := c.SendTokens(context.Background(), tokens, m, WithIdempotencyKey("n1", store))
+	if report.SuccessCount() != 2 || report.Results[0].Skipped {
+		t.Errorf("first report is %+v", report.Results[0])
+	}
+
+	report = c.SendTokens(context.Background(), append(tokens, "c"), m, WithIdempotencyKey("n1", store))
+	if report.SuccessCount() != 3 || !report.Results[0].Skipped || !report.Results[1].Skipped || report.Results[2].Skipped {
+		t.Errorf("replayed report is %+v %+v %+v", report.Results[0], report.Results[1], report.Results[2])
+	}
+
+	c.SendTokens(context.Background(), tokens, m, WithIdempotencyKey("n2", store))
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Errorf("requests are %d", n)
+	}
+}
+
+// fakeMemcache is memcache served by map, it records expiration of items.
+type fakeMemcache struct {
+	mu    sync.Mutex
+	items map[string]time.Duration
+}
+
+func newFakeMemcache() *fakeMemcache {
+	return &fakeMemcache{items: make(map[string]time.Duration)}
+}
+
+func (f *fakeMemcache) Add(ctx context.Context, item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.items[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+	f.items[item.Key] = item.Expiration
+	return nil
+}
+
+func (f *fakeMemcache) Set(ctx context.Context, item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items[item.Key] = item.Expiration
+	return nil
+}
+
+func (f *fakeMemcache) Delete(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.items[key]; !ok {
+		return memcache.ErrCacheMiss
+	}
+	delete(f.items, key)
+	return nil
+}
+
+// sleepWorker sends after short sleep and counts requests.
+type sleepWorker struct {
+	requests *int32
+	err      error
+	res      *Result
+}
+
+func (s *sleepWorker) work(ctx context.Context) error {
+	atomic.AddInt32(s.requests, 1)
+	s.res.Attempts++
+	time.Sleep(10 * time.Millisecond)
+	s.res.Sent = s.err == nil
+	return s.err
+}
+
+func (s *sleepWorker) result() *Result {
+	return s.res
+}
+
+func (s *sleepWorker) host() string {
+	return ""
+}
+
+func (s *sleepWorker) platform() Platform {
+	return PlatformFcm
+}
+
+func TestRunOneConcurrentIdempotencyKey(t *testing.T) {
+	stores := map[string]DedupeStore{
+		"memory":   NewMemoryDedupeStore(0),
+		"memcache": &MemcacheDedupeStore{client: newFakeMemcache()},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			o := newOptions([]Option{WithIdempotencyKey("n1", store), WithRetryPolicy(&RetryPolicy{MaxAttempts: 1})})
+			var requests int32
+			run := func(err error) []*Result {
+				results := make([]*Result, 10)
+				var wg sync.WaitGroup
+				for i := range results {
+					results[i] = &Result{DeviceToken: "a"}
+					wg.Add(1)
+					go func(res *Result) {
+						defer wg.Done()
+						runOne(ctx, &sleepWorker{&requests, err, res}, o)
+					}(results[i])
+				}
+				wg.Wait()
+				return results
+			}
+
+			// failed recipient is released, so it is sent by next run.
+			run(permanent(errors.New("failed")))
+			if n := atomic.LoadInt32(&requests); n != 1 {
+				t.Errorf("requests of failed run are %d", n)
+			}
+
+			var skipped int
+			for _, res := range run(nil) {
+				if !res.Sent {
+					t.Errorf("result is %+v", res)
+				}
+				if res.Skipped {
+					skipped++
+				}
+			}
+			if n := atomic.LoadInt32(&requests); n != 2 || skipped != 9 {
+				t.Errorf("requests are %d, skipped are %d", n, skipped)
+			}
+
+			run(nil)
+			if n := atomic.LoadInt32(&requests); n != 2 {
+				t.Errorf("requests of replayed run are %d", n)
+			}
+		})
+	}
+}
+
+func TestMemcacheDedupeStoreExpiration(t *testing.T) {
+	f := newFakeMemcache()
+	store := &MemcacheDedupeStore{Expiration: time.Hour, PendingExpiration: time.Minute, client: f}
+	ctx := context.Background()
+
+	if ok, err := store.Claim(ctx, "k"); !ok || err != nil {
+		t.Fatalf("claim is %v, %v", ok, err)
+	}
+	if exp := f.items["k"]; exp != time.Minute {
+		t.Errorf("pending expiration is %v", exp)
+	}
+	if ok, err := store.Claim(ctx, "k"); ok || err != nil {
+		t.Errorf("claim of claimed key is %v, %v", ok, err)
+	}
+	if err := store.Confirm(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if exp := f.items["k"]; exp != time.Hour {
+		t.Errorf("expiration is %v", exp)
+	}
+	if err := store.Release(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Release(ctx, "k"); err != nil {
+		t.Errorf("release of missing key is %v", err)
+	}
+}
+
+func TestMemoryDedupeStoreExpiration(t *testing.T) {
+	store := NewMemoryDedupeStore(time.Hour)
+	ctx := context.Background()
+
+	if ok, _ := store.Claim(ctx, "pending"); !ok {
+		t.Fatal("key is not claimed")
+	}
+	if ok, _ := store.Claim(ctx, "sent"); !ok {
+		t.Fatal("key is not claimed")
+	}
+	store.Confirm(ctx, "sent")
+	if exp := store.keys["pending"]; time.Until(exp) > DefaultDedupePendingExpiration {
+		t.Errorf("pending key expires at %v", exp)
+	}
+	if exp := store.keys["sent"]; time.Until(exp) < time.Hour-time.Minute {
+		t.Errorf("sent key expires at %v", exp)
+	}
+
+	// claim of process which died expires, and the key can be claimed again.
+	store.keys["pending"] = time.Now().Add(-time.Second)
+	store.keys["expired"] = time.Now().Add(-time.Second)
+	if ok, _ := store.Claim(ctx, "pending"); !ok {
+		t.Error("expired key is not claimed")
+	}
+	if ok, _ := store.Claim(ctx, "sent"); ok {
+		t.Error("sent key is claimed")
+	}
+	// expired keys are swept once per interval, not at each claim.
+	if _, ok := store.keys["expired"]; !ok {
+		t.Error("expired key is swept before interval")
+	}
+	store.sweepAt = time.Now().Add(-time.Second)
+	store.Claim(ctx, "other")
+	if _, ok := store.keys["expired"]; ok {
+		t.Error("expired key is not swept")
+	}
+}
@@ -0,0 +1,271 @@
+package push
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ContentEncoding is content encoding of encrypted web push payload.
+type ContentEncoding string
+
+const (
+	// AESGCM is content encoding of draft-ietf-webpush-encryption-04.
+	AESGCM ContentEncoding = "aesgcm"
+	// AES128GCM is content encoding of RFC 8188 and RFC 8291.
+	AES128GCM ContentEncoding = "aes128gcm"
+)
+
+const (
+	// DefaultRecordSize is record size used if it is not set.
+	DefaultRecordSize = 4096
+
+	tagSize   = 16
+	saltSize  = 16
+	keySize   = 16
+	nonceSize = 12
+)
+
+// encrypted is encrypted web push payload.
+type encrypted struct {
+	encoding ContentEncoding
+	// body is request body, it has header block if encoding is aes128gcm.
+	body      []byte
+	salt      []byte
+	publicKey []byte
+	rs        int
+}
+
+// encryptPayload encrypts payload for subscription with ephemeral key pair and random salt.
+func encryptPayload(sub *FcmSubscription, payload []byte, rs, padding int) (*encrypted, error) {
+	curve := elliptic.P256()
+	private, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return encryptPayloadWithKey(sub, payload, rs, padding, private, elliptic.Marshal(curve, x, y), salt)
+}
+
+func encryptPayloadWithKey(sub *FcmSubscription, payload []byte, rs, padding int, private, public, salt []byte) (*encrypted, error) {
+	uaPublic, err := decodeBase64(sub.Key)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := decodeBase64(sub.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, uaPublic)
+	if x == nil {
+		return nil, errors.New("subscription key is not valid P-256 public key")
+	}
+	sx, _ := curve.ScalarMult(x, y, private)
+	secret := make([]byte, 32)
+	sb := sx.Bytes()
+	copy(secret[len(secret)-len(sb):], sb)
+
+	if rs <= 0 {
+		rs = DefaultRecordSize
+	}
+
+	e := &encrypted{encoding: sub.encoding(), salt: salt, publicKey: public, rs: rs}
+	switch e.encoding {
+	case AES128GCM:
+		// RFC 8291 section 3.4.
+		info := append([]byte("WebPush: info\x00"), uaPublic...)
+		info = append(info, public...)
+		ikm, err := hkdfDerive(auth, secret, info, 32)
+		if err != nil {
+			return nil, err
+		}
+		e.body, err = encryptAES128GCM(ikm, salt, public, rs, padding, payload)
+		if err != nil {
+			return nil, err
+		}
+	case AESGCM:
+		// draft-ietf-webpush-encryption-04 section 3.3.
+		ikm, err := hkdfDerive(auth, secret, []byte("Content-Encoding: auth\x00"), 32)
+		if err != nil {
+			return nil, err
+		}
+		context := []byte("P-256\x00")
+		context = appendKeyLabel(context, uaPublic)
+		context = appendKeyLabel(context, public)
+		e.body, err = encryptAESGCM(ikm, salt, context, rs, padding, payload)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown content encoding %s", e.encoding)
+	}
+	return e, nil
+}
+
+func appendKeyLabel(b, key []byte) []byte {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(key)))
+	b = append(b, l[:]...)
+	return append(b, key...)
+}
+
+// encryptAES128GCM encrypts plaintext with aes128gcm content encoding of RFC 8188.
+//
+// padding is total length of padding distributed to records from first one.
+func encryptAES128GCM(ikm, salt, keyID []byte, rs, padding int, plaintext []byte) ([]byte, error) {
+	if len(keyID) > 255 {
+		return nil, errors.New("key id must not be longer than 255 bytes")
+	}
+	// record has at least one octet of content or padding, delimiter and tag.
+	if rs < tagSize+2 {
+		return nil, fmt.Errorf("record size %d is too small", rs)
+	}
+
+	gcm, nonce, err := newContentCipher(ikm, salt,
+		[]byte("Content-Encoding: aes128gcm\x00"), []byte("Content-Encoding: nonce\x00"))
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, saltSize+5, saltSize+5+len(keyID))
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[saltSize:], uint32(rs))
+	header[saltSize+4] = byte(len(keyID))
+	header = append(header, keyID...)
+
+	size := rs - tagSize - 1
+	out := header
+	for seq := uint64(0); ; seq++ {
+		record := make([]byte, 0, rs-tagSize)
+		pad := padding
+		if pad > size {
+			pad = size
+		}
+		padding -= pad
+		n := size - pad
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		record = append(record, plaintext[:n]...)
+		plaintext = plaintext[n:]
+
+		last := len(plaintext) == 0 && padding == 0
+		if last {
+			record = append(record, 2)
+		} else {
+			record = append(record, 1)
+		}
+		record = append(record, make([]byte, pad)...)
+		out = gcm.Seal(out, recordNonce(nonce, seq), record, nil)
+		if last {
+			return out, nil
+		}
+	}
+}
+
+// encryptAESGCM encrypts plaintext with aesgcm content encoding of draft-ietf-httpbis-encryption-encoding-03.
+//
+// Unlike aes128gcm, rs is size of plaintext record and padding length is prefixed to each record.
+func encryptAESGCM(ikm, salt, context []byte, rs, padding int, plaintext []byte) ([]byte, error) {
+	if rs < 3 {
+		return nil, fmt.Errorf("record size %d is too small", rs)
+	}
+
+	gcm, nonce, err := newContentCipher(ikm, salt,
+		append([]byte("Content-Encoding: aesgcm\x00"), context...), append([]byte("Content-Encoding: nonce\x00"), context...))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for seq := uint64(0); ; seq++ {
+		pad := padding
+		if pad > rs-2 {
+			pad = rs - 2
+		}
+		if pad > 0xffff {
+			pad = 0xffff
+		}
+		padding -= pad
+		n := rs - 2 - pad
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+
+		record := make([]byte, 2+pad, 2+pad+n)
+		binary.BigEndian.PutUint16(record, uint16(pad))
+		record = append(record, plaintext[:n]...)
+		plaintext = plaintext[n:]
+		out = gcm.Seal(out, recordNonce(nonce, seq), record, nil)
+
+		// record shorter than rs marks the end of content.
+		if len(record) < rs {
+			return out, nil
+		}
+	}
+}
+
+func newContentCipher(ikm, salt, keyInfo, nonceInfo []byte) (cipher.AEAD, []byte, error) {
+	cek, err := hkdfDerive(salt, ikm, keyInfo, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdfDerive(salt, ikm, nonceInfo, nonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonce, nil
+}
+
+// recordNonce return nonce of record, it is XOR of base nonce and sequence number.
+func recordNonce(nonce []byte, seq uint64) []byte {
+	n := make([]byte, nonceSize)
+	copy(n, nonce)
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], seq)
+	for i := range s {
+		n[nonceSize-8+i] ^= s[i]
+	}
+	return n
+}
+
+// hkdfDerive derives n bytes key with HKDF-SHA256.
+func hkdfDerive(salt, secret, info []byte, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// decodeBase64 decodes url safe or standard base64 with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,151 @@
+package push
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 8188 section 3.1 and 3.2.
+func TestEncryptAES128GCM(t *testing.T) {
+	tests := []struct {
+		name      string
+		ikm, salt string
+		keyID     string
+		rs        int
+		padding   int
+		want      string
+	}{
+		{
+			name: "single record",
+			ikm:  "yqdlZ-tYemfogSmv7Ws5PQ",
+			salt: "I1BsxtFttlv3u_Oo94xnmw",
+			rs:   4096,
+			want: "I1BsxtFttlv3u_Oo94xnmwAAEAAA-NAVub2qFgBEuQKRapoZu-IxkIva3MEB1PD-ly8Thjg",
+		},
+		{
+			name:    "multiple records",
+			ikm:     "BO3ZVPxUlnLORbVGMpbT1Q",
+			salt:    "uNCkWiNYzKTnBN9ji3-qWA",
+			keyID:   "a1",
+			rs:      25,
+			padding: 1,
+			want:    "uNCkWiNYzKTnBN9ji3-qWAAAABkCYTHOG8chz_gnvgOqdGYovxyjuqRyJFjEDyoF1Fvkj6hQPdPHI51OEUKEpgz3SsLWIqS_uA",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encryptAES128GCM(mustDecode(t, tt.ikm), mustDecode(t, tt.salt), []byte(tt.keyID), tt.rs, tt.padding, []byte("I am the walrus"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := base64.RawURLEncoding.EncodeToString(got); s != tt.want {
+				t.Errorf("got %s, want %s", s, tt.want)
+			}
+		})
+	}
+}
+
+// RFC 8291 appendix A.
+func TestEncryptPayloadAES128GCM(t *testing.T) {
+	sub := &FcmSubscription{
+		Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV",
+		Key:      "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		Auth:     "BTBZMqHH6r4Tts7J_aSIgg",
+		Encoding: AES128GCM,
+	}
+	private := mustDecode(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	public := mustDecode(t, "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8")
+	salt := mustDecode(t, "DGv6ra1nlYgDCS1FRnbzlw")
+
+	e, err := encryptPayloadWithKey(sub, []byte("When I grow up, I want to be a watermelon"), 4096, 0, private, public, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := base64.RawURLEncoding.EncodeToString(e.body); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestEncryptPayloadAESGCM(t *testing.T) {
+	curve := elliptic.P256()
+	uaPrivate, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPublic := elliptic.Marshal(curve, x, y)
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	sub := &FcmSubscription{
+		Key:  base64.RawURLEncoding.EncodeToString(uaPublic),
+		Auth: base64.RawURLEncoding.EncodeToString(auth),
+	}
+
+	tests := []struct {
+		name        string
+		rs, padding int
+		payload     string
+	}{
+		{"default", 0, 0, "hello"},
+		{"padding", 0, 100, "hello"},
+		{"multiple records", 8, 3, "hello, world"},
+		{"full record", 7, 0, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := encryptPayload(sub, []byte(tt.payload), tt.rs, tt.padding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.encoding != AESGCM {
+				t.Fatalf("encoding is %s", e.encoding)
+			}
+
+			// decrypt with user agent key.
+			asX, asY := elliptic.Unmarshal(curve, e.publicKey)
+			sx, _ := curve.ScalarMult(asX, asY, uaPrivate)
+			secret := make([]byte, 32)
+			copy(secret[32-len(sx.Bytes()):], sx.Bytes())
+			ikm, _ := hkdfDerive(auth, secret, []byte("Content-Encoding: auth\x00"), 32)
+			context := appendKeyLabel(appendKeyLabel([]byte("P-256\x00"), uaPublic), e.publicKey)
+			cek, _ := hkdfDerive(e.salt, ikm, append([]byte("Content-Encoding: aesgcm\x00"), context...), 16)
+			nonce, _ := hkdfDerive(e.salt, ikm, append([]byte("Content-Encoding: nonce\x00"), context...), 12)
+			block, _ := aes.NewCipher(cek)
+			gcm, _ := cipher.NewGCM(block)
+
+			var got []byte
+			body := e.body
+			for seq := uint64(0); len(body) > 0; seq++ {
+				n := e.rs + tagSize
+				if n > len(body) {
+					n = len(body)
+				}
+				record, err := gcm.Open(nil, recordNonce(nonce, seq), body[:n], nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = body[n:]
+				pad := int(binary.BigEndian.Uint16(record))
+				got = append(got, record[2+pad:]...)
+			}
+			if !bytes.Equal(got, []byte(tt.payload)) {
+				t.Errorf("got %q, want %q", got, tt.payload)
+			}
+		})
+	}
+}
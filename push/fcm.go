@@ -0,0 +1,318 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/koichirokamoto/gko/log"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// FcmScope is oauth2 scope of fcm http v1 api.
+	FcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+	fcmV1URL = "https://fcm.googleapis.com"
+)
+
+// Message is message of fcm http v1 api.
+//
+// One of Token, Topic and Condition must be set.
+type Message struct {
+	Token     string `json:"token,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Condition string `json:"condition,omitempty"`
+
+	Data         map[string]string    `json:"data,omitempty"`
+	Notification *MessageNotification `json:"notification,omitempty"`
+	Android      *AndroidConfig       `json:"android,omitempty"`
+	Webpush      *WebpushConfig       `json:"webpush,omitempty"`
+	Apns         *ApnsConfig          `json:"apns,omitempty"`
+	FcmOptions   *FcmOptions          `json:"fcm_options,omitempty"`
+}
+
+// MessageNotification is notification shown on all platforms.
+type MessageNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	Image string `json:"image,omitempty"`
+}
+
+// AndroidConfig is android specific options.
+type AndroidConfig struct {
+	CollapseKey  string               `json:"collapse_key,omitempty"`
+	Priority     string               `json:"priority,omitempty"`
+	TTL          string               `json:"ttl,omitempty"`
+	Data         map[string]string    `json:"data,omitempty"`
+	Notification *AndroidNotification `json:"notification,omitempty"`
+}
+
+// AndroidNotification is notification shown on android.
+type AndroidNotification struct {
+	Title        string   `json:"title,omitempty"`
+	Body         string   `json:"body,omitempty"`
+	Icon         string   `json:"icon,omitempty"`
+	Color        string   `json:"color,omitempty"`
+	Sound        string   `json:"sound,omitempty"`
+	Tag          string   `json:"tag,omitempty"`
+	ClickAction  string   `json:"click_action,omitempty"`
+	ChannelID    string   `json:"channel_id,omitempty"`
+	BodyLocKey   string   `json:"body_loc_key,omitempty"`
+	BodyLocArgs  []string `json:"body_loc_args,omitempty"`
+	TitleLocKey  string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs []string `json:"title_loc_args,omitempty"`
+}
+
+// WebpushConfig is web push specific options.
+type WebpushConfig struct {
+	Headers      map[string]string      `json:"headers,omitempty"`
+	Data         map[string]string      `json:"data,omitempty"`
+	Notification map[string]interface{} `json:"notification,omitempty"`
+	FcmOptions   *WebpushFcmOptions     `json:"fcm_options,omitempty"`
+}
+
+// WebpushFcmOptions is fcm options of web push.
+type WebpushFcmOptions struct {
+	Link string `json:"link,omitempty"`
+}
+
+// ApnsConfig is apns specific options.
+//
+// Payload is json object of apns payload.
+type ApnsConfig struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload json.RawMessage   `json:"payload,omitempty"`
+}
+
+// FcmOptions is fcm options of all platforms.
+type FcmOptions struct {
+	AnalyticsLabel string `json:"analytics_label,omitempty"`
+}
+
+func (m *Message) validate() error {
+	var n int
+	for _, t := range []string{m.Token, m.Topic, m.Condition} {
+		if t != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of token, topic and condition must be set")
+	}
+	return nil
+}
+
+// FcmError is error returned by fcm http v1 api.
+type FcmError struct {
+	StatusCode int
+	// Status is canonical error status, e.g. INVALID_ARGUMENT.
+	Status string
+	// ErrorCode is fcm error code, e.g. UNREGISTERED.
+	ErrorCode  string
+	Message    string
+	retryAfter string
+}
+
+func (e *FcmError) Error() string {
+	return fmt.Sprintf("fcm: %d %s %s %s", e.StatusCode, e.Status, e.ErrorCode, e.Message)
+}
+
+// fcmTokenError is error of token source, it is distinguished from invalid message to be retried.
+type fcmTokenError struct {
+	err error
+}
+
+func (e *fcmTokenError) Error() string {
+	return e.err.Error()
+}
+
+// retryable reports whether token can be retrieved by retry.
+//
+// Token endpoint answered error is retried only if it is 429 or 5xx,
+// other errors like metadata server failure are retried as network error.
+func (e *fcmTokenError) retryable() bool {
+	if re, ok := e.err.(*oauth2.RetrieveError); ok && re.Response != nil {
+		return isRetryableStatus(re.Response.StatusCode)
+	}
+	return isRetryable(e.err)
+}
+
+// FcmClient is client of fcm http v1 api.
+type FcmClient struct {
+	c         *http.Client
+	projectID string
+	ts        oauth2.TokenSource
+	endpoint  string
+}
+
+// NewFcmClient return new fcm client authenticated by token source.
+//
+// Token source must have FcmScope.
+func NewFcmClient(c *http.Client, projectID string, ts oauth2.TokenSource) *FcmClient {
+	return &FcmClient{c, projectID, ts, fcmV1URL}
+}
+
+// NewFcmClientFromServiceAccount return new fcm client authenticated by service account json key.
+func NewFcmClientFromServiceAccount(ctx context.Context, c *http.Client, jsonKey []byte) (*FcmClient, error) {
+	conf, err := google.JWTConfigFromJSON(jsonKey, FcmScope)
+	if err != nil {
+		return nil, err
+	}
+	var key struct {
+		ProjectID string `json:"project_id"`
+	}
+	if err := json.Unmarshal(jsonKey, &key); err != nil {
+		return nil, err
+	}
+	return NewFcmClient(c, key.ProjectID, conf.TokenSource(ctx)), nil
+}
+
+// Send sends message and return message name.
+func (f *FcmClient) Send(ctx context.Context, m *Message) (string, error) {
+	if err := m.validate(); err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"message": m})
+	if err != nil {
+		return "", err
+	}
+	u := f.endpoint + "/v1/projects/" + url.PathEscape(f.projectID) + "/messages:send"
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	token, err := f.ts.Token()
+	if err != nil {
+		return "", &fcmTokenError{err}
+	}
+	token.SetAuthHeader(req)
+
+	res, err := f.c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if 400 <= res.StatusCode {
+		return "", newFcmError(res, b)
+	}
+
+	var ret struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return "", err
+	}
+	return ret.Name, nil
+}
+
+func newFcmError(res *http.Response, b []byte) *FcmError {
+	fe := &FcmError{StatusCode: res.StatusCode, retryAfter: res.Header.Get("Retry-After")}
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				Type      string `json:"@type"`
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		fe.Message = string(b)
+		return fe
+	}
+	fe.Status = e.Error.Status
+	fe.Message = e.Error.Message
+	for _, d := range e.Error.Details {
+		if d.ErrorCode != "" {
+			fe.ErrorCode = d.ErrorCode
+			break
+		}
+	}
+	return fe
+}
+
+// SendTokens sends message to each registration token.
+//
+// Token, Topic and Condition of message are ignored.
+// Returned report contains delivery result of each token.
+func (f *FcmClient) SendTokens(ctx context.Context, tokens []string, m *Message, opts ...Option) *Report {
+	wrk := make([]worker, len(tokens))
+	for i, t := range tokens {
+		msg := *m
+		msg.Token, msg.Topic, msg.Condition = t, "", ""
+		wrk[i] = &fcmV1Worker{f, &msg, &Result{DeviceToken: t}}
+	}
+
+	return runWorker(ctx, wrk, newOptions(opts))
+}
+
+type fcmV1Worker struct {
+	c   *FcmClient
+	msg *Message
+	res *Result
+}
+
+func (f *fcmV1Worker) result() *Result {
+	return f.res
+}
+
+func (f *fcmV1Worker) platform() Platform {
+	return PlatformFcm
+}
+
+func (f *fcmV1Worker) host() string {
+	u, err := url.Parse(f.c.endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func (f *fcmV1Worker) work(ctx context.Context) error {
+	f.res.Attempts++
+	_, err := f.c.Send(ctx, f.msg)
+	if err == nil {
+		f.res.Sent = true
+		f.res.StatusCode = http.StatusOK
+		f.res.Reason = ""
+		return nil
+	}
+
+	log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+	fe, ok := err.(*FcmError)
+	if !ok {
+		switch e := err.(type) {
+		case *url.Error:
+			// network error of request to fcm.
+			return err
+		case *fcmTokenError:
+			return &sendError{msg: e.Error(), retryable: e.retryable()}
+		}
+		// invalid message or response is not fixed by retry.
+		return permanent(err)
+	}
+	f.res.StatusCode = fe.StatusCode
+	f.res.Reason = fe.ErrorCode
+	f.res.Invalid = fe.ErrorCode == "UNREGISTERED"
+	return &sendError{
+		msg:        fe.Error(),
+		retryable:  isRetryableStatus(fe.StatusCode),
+		retryAfter: parseRetryAfter(fe.retryAfter),
+	}
+}
@@ -0,0 +1,190 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func newTestFcmClient(h http.HandlerFunc) (*FcmClient, func()) {
+	ts := httptest.NewServer(h)
+	c := NewFcmClient(ts.Client(), "test-project", oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}))
+	c.endpoint = ts.URL
+	return c, ts.Close
+}
+
+func TestFcmClientSend(t *testing.T) {
+	var got struct {
+		Message *Message `json:"message"`
+	}
+	c, done := newTestFcmClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/test-project/messages:send" {
+			t.Errorf("path is %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("authorization is %s", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(`{"name":"projects/test-project/messages/1"}`))
+	})
+	defer done()
+
+	m := &Message{
+		Topic:        "news",
+		Notification: &MessageNotification{Title: "title", Body: "body"},
+		Android:      &AndroidConfig{Priority: "high"},
+		Apns:         &ApnsConfig{Payload: json.RawMessage(`{"aps":{"badge":1}}`)},
+	}
+	name, err := c.Send(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "projects/test-project/messages/1" {
+		t.Errorf("name is %s", name)
+	}
+	if got.Message.Topic != "news" || got.Message.Notification.Title != "title" || got.Message.Android.Priority != "high" {
+		t.Errorf("message is %+v", got.Message)
+	}
+	if string(got.Message.Apns.Payload) != `{"aps":{"badge":1}}` {
+		t.Errorf("apns payload is %s", got.Message.Apns.Payload)
+	}
+
+	if _, err := c.Send(context.Background(), &Message{Token: "a", Topic: "b"}); err == nil {
+		t.Error("message with token and topic is sent")
+	}
+}
+
+type testInvalidHandler struct {
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (h *testInvalidHandler) InvalidSubscription(ctx context.Context, sub *FcmSubscription) error {
+	return nil
+}
+
+func (h *testInvalidHandler) InvalidDeviceToken(ctx context.Context, token string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens = append(h.tokens, token)
+	return nil
+}
+
+func TestFcmClientSendTokens(t *testing.T) {
+	c, done := newTestFcmClient(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Message *Message `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Message.Token {
+		case "valid":
+			w.Write([]byte(`{"name":"projects/test-project/messages/1"}`))
+		case "unregistered":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"message":"invalid","status":"INVALID_ARGUMENT"}}`))
+		}
+	})
+	defer done()
+
+	h := &testInvalidHandler{}
+	report := c.SendTokens(context.Background(), []string{"valid", "unregistered", "bad"}, &Message{Data: map[string]string{"k": "v"}}, WithInvalidRecipientHandler(h))
+
+	if n := report.SuccessCount(); n != 1 {
+		t.Errorf("success count is %d", n)
+	}
+	valid, unregistered, bad := report.Results[0], report.Results[1], report.Results[2]
+	if !valid.Sent || valid.Attempts != 1 {
+		t.Errorf("valid result is %+v", valid)
+	}
+	if unregistered.Sent || !unregistered.Invalid || unregistered.Reason != "UNREGISTERED" || unregistered.Attempts != 1 {
+		t.Errorf("unregistered result is %+v", unregistered)
+	}
+	if bad.Sent || bad.Invalid || bad.StatusCode != http.StatusBadRequest || bad.Attempts != 1 {
+		t.Errorf("bad result is %+v", bad)
+	}
+	if len(h.tokens) != 1 || h.tokens[0] != "unregistered" {
+		t.Errorf("invalid tokens are %v", h.tokens)
+	}
+}
+
+// errTokenSource fails with errors in order, and then return token.
+type errTokenSource struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (e *errTokenSource) Token() (*oauth2.Token, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.errs) == 0 {
+		return &oauth2.Token{AccessToken: "token"}, nil
+	}
+	err := e.errs[0]
+	e.errs = e.errs[1:]
+	return nil, err
+}
+
+func retrieveError(code int) error {
+	return &oauth2.RetrieveError{Response: &http.Response{StatusCode: code}, ErrorCode: http.StatusText(code)}
+}
+
+func TestFcmClientSendTokensPermanentError(t *testing.T) {
+	var requests int32
+	c, done := newTestFcmClient(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"name":"projects/test-project/messages/1"}`))
+	})
+	defer done()
+
+	policy := &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 1}
+	report := c.SendTokens(context.Background(), []string{""}, &Message{}, WithRetryPolicy(policy))
+	if res := report.Results[0]; res.Sent || res.Attempts != 1 || res.Err == nil {
+		t.Errorf("empty token result is %+v", res)
+	}
+
+	c.ts = &errTokenSource{errs: []error{retrieveError(http.StatusBadRequest), nil}}
+	report = c.SendTokens(context.Background(), []string{"token"}, &Message{}, WithRetryPolicy(policy))
+	if res := report.Results[0]; res.Sent || res.Attempts != 1 || res.Err == nil {
+		t.Errorf("credential failure result is %+v", res)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("requests are %d", n)
+	}
+}
+
+func TestFcmClientSendTokensTokenError(t *testing.T) {
+	c, done := newTestFcmClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"projects/test-project/messages/1"}`))
+	})
+	defer done()
+
+	policy := &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 1}
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"token endpoint unavailable", retrieveError(http.StatusServiceUnavailable)},
+		{"token endpoint rate limited", retrieveError(http.StatusTooManyRequests)},
+		{"metadata server error", errors.New("metadata: connection reset")},
+	}
+	for _, tt := range tests {
+		c.ts = &errTokenSource{errs: []error{tt.err}}
+		report := c.SendTokens(context.Background(), []string{"token"}, &Message{}, WithRetryPolicy(policy))
+		if res := report.Results[0]; !res.Sent || res.Attempts != 2 {
+			t.Errorf("%s: result is %+v", tt.name, res)
+		}
+	}
+}
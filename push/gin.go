@@ -0,0 +1,20 @@
+package push
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// SubscribeGin is gin handler of Subscribe.
+func (h *SubscriptionHandler) SubscribeGin(c *gin.Context) {
+	h.Subscribe(c.Writer, c.Request)
+}
+
+// UpdateGin is gin handler of Update.
+func (h *SubscriptionHandler) UpdateGin(c *gin.Context) {
+	h.Update(c.Writer, c.Request)
+}
+
+// UnsubscribeGin is gin handler of Unsubscribe.
+func (h *SubscriptionHandler) UnsubscribeGin(c *gin.Context) {
+	h.Unsubscribe(c.Writer, c.Request)
+}
@@ -0,0 +1,85 @@
+package push
+
+import (
+	"net/http"
+
+	"github.com/mjibson/goon"
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var _ InvalidRecipientHandler = (*DatastoreInvalidRecipientHandler)(nil)
+
+// InvalidRecipientHandler is handler of recipient which push service answers is no longer valid.
+type InvalidRecipientHandler interface {
+	// InvalidSubscription is called with web push subscription answered 404 or 410.
+	InvalidSubscription(context.Context, *FcmSubscription) error
+	// InvalidDeviceToken is called with apns device token answered BadDeviceToken or Unregistered,
+	// or fcm registration token answered UNREGISTERED.
+	InvalidDeviceToken(context.Context, string) error
+}
+
+func isInvalidSubscriptionStatus(code int) bool {
+	return code == http.StatusNotFound || code == http.StatusGone
+}
+
+func isInvalidDeviceTokenReason(reason string) bool {
+	return reason == apns2.ReasonBadDeviceToken || reason == apns2.ReasonUnregistered
+}
+
+// DatastoreInvalidRecipientHandler deletes entities of invalid recipient from datastore.
+//
+// Entities are deleted with goon so that its cache is also cleared.
+type DatastoreInvalidRecipientHandler struct {
+	// SubscriptionKind is kind of entity which has web push subscription endpoint.
+	SubscriptionKind string
+	// EndpointField is name of property of subscription endpoint.
+	EndpointField string
+	// DeviceTokenKind is kind of entity which has apns device token.
+	DeviceTokenKind string
+	// DeviceTokenField is name of property of device token.
+	DeviceTokenField string
+
+	// store return store of entities, goon of context is used if it is nil.
+	store func(context.Context) keysDeleter
+}
+
+// keysDeleter queries keys and deletes them, it is implemented by goon.
+type keysDeleter interface {
+	GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, error)
+	DeleteMulti(keys []*datastore.Key) error
+}
+
+func (d *DatastoreInvalidRecipientHandler) entities(ctx context.Context) keysDeleter {
+	if d.store == nil {
+		return goon.FromContext(ctx)
+	}
+	return d.store(ctx)
+}
+
+// InvalidSubscription deletes entities whose endpoint is equal to subscription endpoint.
+func (d *DatastoreInvalidRecipientHandler) InvalidSubscription(ctx context.Context, sub *FcmSubscription) error {
+	return deleteByField(d.entities(ctx), d.SubscriptionKind, d.EndpointField, sub.Endpoint)
+}
+
+// InvalidDeviceToken deletes entities whose device token is equal to token.
+func (d *DatastoreInvalidRecipientHandler) InvalidDeviceToken(ctx context.Context, token string) error {
+	return deleteByField(d.entities(ctx), d.DeviceTokenKind, d.DeviceTokenField, token)
+}
+
+func deleteByField(g keysDeleter, kind, field, value string) error {
+	if kind == "" || field == "" {
+		return nil
+	}
+
+	q := datastore.NewQuery(kind).Filter(field+" =", value).KeysOnly()
+	keys, err := g.GetAll(q, nil)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return g.DeleteMulti(keys)
+}
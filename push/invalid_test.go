@@ -0,0 +1,82 @@
+package push
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type fakeKeysDeleter struct {
+	keys    []*datastore.Key
+	err     error
+	queries []*datastore.Query
+	dsts    []interface{}
+	deleted [][]*datastore.Key
+}
+
+func (f *fakeKeysDeleter) GetAll(q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	f.queries = append(f.queries, q)
+	f.dsts = append(f.dsts, dst)
+	return f.keys, f.err
+}
+
+func (f *fakeKeysDeleter) DeleteMulti(keys []*datastore.Key) error {
+	f.deleted = append(f.deleted, keys)
+	return nil
+}
+
+func TestDatastoreInvalidRecipientHandler(t *testing.T) {
+	keys := []*datastore.Key{new(datastore.Key), new(datastore.Key)}
+	f := &fakeKeysDeleter{keys: keys}
+	h := &DatastoreInvalidRecipientHandler{
+		SubscriptionKind: "Subscription",
+		EndpointField:    "Endpoint",
+		DeviceTokenKind:  "Device",
+		DeviceTokenField: "Token",
+		store:            func(context.Context) keysDeleter { return f },
+	}
+	ctx := context.Background()
+
+	if err := h.InvalidSubscription(ctx, &FcmSubscription{Endpoint: "https://push.example.com/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.InvalidDeviceToken(ctx, "token"); err != nil {
+		t.Fatal(err)
+	}
+	want := []*datastore.Query{
+		datastore.NewQuery("Subscription").Filter("Endpoint =", "https://push.example.com/a").KeysOnly(),
+		datastore.NewQuery("Device").Filter("Token =", "token").KeysOnly(),
+	}
+	if !reflect.DeepEqual(f.queries, want) {
+		t.Errorf("queries are %v, want %v", f.queries, want)
+	}
+	for _, dst := range f.dsts {
+		if dst != nil {
+			t.Errorf("entities are loaded to %v", dst)
+		}
+	}
+	if len(f.deleted) != 2 || !reflect.DeepEqual(f.deleted[0], keys) || !reflect.DeepEqual(f.deleted[1], keys) {
+		t.Errorf("deleted keys are %v", f.deleted)
+	}
+
+	// nothing is deleted if no entity matches or kind is not set.
+	f = &fakeKeysDeleter{}
+	if err := h.InvalidDeviceToken(ctx, "token"); err != nil {
+		t.Fatal(err)
+	}
+	h.SubscriptionKind = ""
+	if err := h.InvalidSubscription(ctx, &FcmSubscription{Endpoint: "https://push.example.com/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.queries) != 1 || len(f.deleted) != 0 {
+		t.Errorf("queries are %v, deleted keys are %v", f.queries, f.deleted)
+	}
+
+	f = &fakeKeysDeleter{err: errors.New("datastore error")}
+	if err := h.InvalidDeviceToken(ctx, "token"); err == nil || len(f.deleted) != 0 {
+		t.Errorf("error is %v, deleted keys are %v", err, f.deleted)
+	}
+}
@@ -0,0 +1,333 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	_ Notifier = (*RoutingNotifier)(nil)
+	_ Renderer = (*DefaultRenderer)(nil)
+)
+
+// Platform is platform of device.
+type Platform int
+
+const (
+	// PlatformWebPush is browser which receives encrypted web push.
+	PlatformWebPush Platform = iota
+	// PlatformFcm is android or ios app which receives fcm.
+	PlatformFcm
+	// PlatformApns is ios app which receives apns.
+	PlatformApns
+)
+
+func (p Platform) String() string {
+	switch p {
+	case PlatformWebPush:
+		return "webpush"
+	case PlatformFcm:
+		return "fcm"
+	case PlatformApns:
+		return "apns"
+	}
+	return "unknown"
+}
+
+// Device is device which receives notification.
+type Device struct {
+	Platform Platform
+	// Token is fcm registration token or apns device token.
+	Token string
+	// Subscription is web push subscription.
+	Subscription *FcmSubscription
+	Locale       string
+	AppVersion   string
+}
+
+// Notification is platform agnostic notification.
+type Notification struct {
+	Title string
+	Body  string
+	// Icon is url of icon shown on web push and android.
+	Icon string
+	// Link is url opened when notification is clicked.
+	Link string
+	// Badge is number shown on ios app icon.
+	Badge *int
+	Sound string
+	Data  map[string]string
+}
+
+// Notifier sends notification to devices.
+type Notifier interface {
+	// Notify sends notification to devices.
+	//
+	// Returned report has the same order as devices.
+	Notify(context.Context, *Notification, []*Device) (*Report, error)
+}
+
+// NotifyError is error of devices which were not sent because rendering or platform failed.
+//
+// Delivery failures answered by push services are reported only in results.
+type NotifyError struct {
+	// Errors are distinct errors of failed devices.
+	Errors []error
+}
+
+func (e *NotifyError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "notify failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *NotifyError) add(err error) {
+	for _, ex := range e.Errors {
+		if ex.Error() == err.Error() {
+			return
+		}
+	}
+	e.Errors = append(e.Errors, err)
+}
+
+// Renderer renders notification to platform specific payload for device.
+type Renderer interface {
+	WebPush(*Notification, *Device) ([]byte, error)
+	Fcm(*Notification, *Device) (*Message, error)
+	Apns(*Notification, *Device) (*ApnsPayload, *ApnsHeaders, error)
+}
+
+// DefaultRenderer renders notification as it is, regardless of device.
+type DefaultRenderer struct{}
+
+// WebPush renders json which has title, body, icon, link and data.
+func (d *DefaultRenderer) WebPush(n *Notification, _ *Device) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"title": n.Title,
+		"body":  n.Body,
+		"icon":  n.Icon,
+		"link":  n.Link,
+		"data":  n.Data,
+	})
+}
+
+// Fcm renders fcm message which has notification and data.
+//
+// Link is set to fcm options of web push, and to link of data for apps unless data has it.
+func (d *DefaultRenderer) Fcm(n *Notification, _ *Device) (*Message, error) {
+	m := &Message{
+		Notification: &MessageNotification{Title: n.Title, Body: n.Body},
+		Data:         n.Data,
+	}
+	if n.Icon != "" || n.Sound != "" {
+		m.Android = &AndroidConfig{Notification: &AndroidNotification{Icon: n.Icon, Sound: n.Sound}}
+	}
+	if n.Link != "" {
+		m.Webpush = &WebpushConfig{FcmOptions: &WebpushFcmOptions{Link: n.Link}}
+		if _, ok := n.Data["link"]; !ok {
+			m.Data = make(map[string]string, len(n.Data)+1)
+			for k, v := range n.Data {
+				m.Data[k] = v
+			}
+			m.Data["link"] = n.Link
+		}
+	}
+	return m, nil
+}
+
+// Apns renders apns payload which has alert, badge, sound and data.
+//
+// Link is set to link key of payload unless data has it.
+func (d *DefaultRenderer) Apns(n *Notification, _ *Device) (*ApnsPayload, *ApnsHeaders, error) {
+	p := &ApnsPayload{
+		Alert: &ApnsAlert{Title: n.Title, Body: n.Body},
+		Badge: n.Badge,
+		Sound: n.Sound,
+	}
+	if len(n.Data) > 0 || n.Link != "" {
+		p.Data = make(map[string]interface{}, len(n.Data)+1)
+		if n.Link != "" {
+			p.Data["link"] = n.Link
+		}
+		for k, v := range n.Data {
+			p.Data[k] = v
+		}
+	}
+	return p, &ApnsHeaders{PushType: ApnsPushTypeAlert}, nil
+}
+
+// RoutingNotifier routes notification to web push, fcm or apns by platform of device.
+//
+// Devices which get the same payload are sent at once.
+type RoutingNotifier struct {
+	// HTTPClient and ServerKey are used for web push.
+	HTTPClient *http.Client
+	ServerKey  string
+	Fcm        *FcmClient
+	Apns       *ApnsClient
+	// ApnsTopic is used if rendered apns headers do not have topic.
+	ApnsTopic string
+	// Renderer is DefaultRenderer if it is nil.
+	Renderer Renderer
+	// Options are applied to sends of all platforms.
+	Options []Option
+}
+
+// routeGroup is devices which get the same payload.
+type routeGroup struct {
+	platform Platform
+	index    []int
+	devices  []*Device
+
+	webpush []byte
+	message *Message
+	payload *ApnsPayload
+	headers *ApnsHeaders
+}
+
+// Notify renders notification for each device and sends it.
+//
+// Device which is nil, of which rendering fails or platform client is not set gets failed result,
+// and *NotifyError which has their errors is returned with report.
+// Timeout of options is deadline of whole notify, not of each platform.
+func (r *RoutingNotifier) Notify(ctx context.Context, n *Notification, devices []*Device) (*Report, error) {
+	if o := newOptions(r.Options); o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	report := &Report{Results: make([]*Result, len(devices))}
+	notifyErr := &NotifyError{}
+	groups := make(map[string]*routeGroup)
+	var keys []string
+	for i, d := range devices {
+		if d == nil {
+			err := errors.New("device is nil")
+			report.Results[i] = &Result{Err: err}
+			notifyErr.add(err)
+			continue
+		}
+		key, g, err := r.render(n, d)
+		if err != nil {
+			report.Results[i] = &Result{Subscription: d.Subscription, DeviceToken: d.Token, Err: err}
+			notifyErr.add(err)
+			continue
+		}
+		if ex, ok := groups[key]; ok {
+			g = ex
+		} else {
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.index = append(g.index, i)
+		g.devices = append(g.devices, d)
+	}
+
+	for _, key := range keys {
+		g := groups[key]
+		sub, err := r.send(ctx, g)
+		if err != nil {
+			notifyErr.add(fmt.Errorf("%s: %v", g.platform, err))
+			for _, i := range g.index {
+				d := devices[i]
+				report.Results[i] = &Result{Subscription: d.Subscription, DeviceToken: d.Token, Err: err}
+			}
+			continue
+		}
+		for j, i := range g.index {
+			report.Results[i] = sub.Results[j]
+		}
+	}
+	if len(notifyErr.Errors) > 0 {
+		return report, notifyErr
+	}
+	return report, nil
+}
+
+func (r *RoutingNotifier) renderer() Renderer {
+	if r.Renderer == nil {
+		return &DefaultRenderer{}
+	}
+	return r.Renderer
+}
+
+// render renders payload for device and return key of group.
+func (r *RoutingNotifier) render(n *Notification, d *Device) (string, *routeGroup, error) {
+	g := &routeGroup{platform: d.Platform}
+	var b []byte
+	var err error
+	switch d.Platform {
+	case PlatformWebPush:
+		if d.Subscription == nil {
+			return "", nil, fmt.Errorf("web push device does not have subscription")
+		}
+		g.webpush, err = r.renderer().WebPush(n, d)
+		b = g.webpush
+	case PlatformFcm:
+		g.message, err = r.renderer().Fcm(n, d)
+		if err == nil {
+			b, err = json.Marshal(g.message)
+		}
+	case PlatformApns:
+		g.payload, g.headers, err = r.renderer().Apns(n, d)
+		if err == nil {
+			b, err = json.Marshal([]interface{}{g.payload, g.headers})
+		}
+	default:
+		err = fmt.Errorf("unknown platform %d", d.Platform)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return d.Platform.String() + ":" + string(b), g, nil
+}
+
+func (r *RoutingNotifier) send(ctx context.Context, g *routeGroup) (*Report, error) {
+	switch g.platform {
+	case PlatformWebPush:
+		if r.HTTPClient == nil {
+			return nil, fmt.Errorf("http client for web push is not set")
+		}
+		subs := make([]*FcmSubscription, len(g.devices))
+		for i, d := range g.devices {
+			subs[i] = d.Subscription
+		}
+		return SendFcmNotification(ctx, r.HTTPClient, r.ServerKey, subs, g.webpush, r.Options...), nil
+	case PlatformFcm:
+		if r.Fcm == nil {
+			return nil, fmt.Errorf("fcm client is not set")
+		}
+		return r.Fcm.SendTokens(ctx, tokens(g.devices), g.message, r.Options...), nil
+	case PlatformApns:
+		if r.Apns == nil {
+			return nil, fmt.Errorf("apns client is not set")
+		}
+		h := g.headers
+		if h == nil {
+			h = &ApnsHeaders{}
+		}
+		if h.Topic == "" {
+			c := *h
+			c.Topic = r.ApnsTopic
+			h = &c
+		}
+		return r.Apns.SendNotification(ctx, tokens(g.devices), g.payload, h, r.Options...)
+	}
+	return nil, fmt.Errorf("unknown platform %d", g.platform)
+}
+
+func tokens(devices []*Device) []string {
+	t := make([]string, len(devices))
+	for i, d := range devices {
+		t[i] = d.Token
+	}
+	return t
+}
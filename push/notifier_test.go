@@ -0,0 +1,149 @@
+package push_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koichirokamoto/gko/push"
+	"github.com/koichirokamoto/gko/testutil"
+	"golang.org/x/net/context"
+)
+
+func TestRoutingNotifierNotify(t *testing.T) {
+	ws, err := testutil.NewFakeWebPushServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	as := testutil.NewFakeApnsServer()
+	defer as.Close()
+
+	r := &push.RoutingNotifier{
+		HTTPClient: ws.Client(),
+		Apns:       push.NewApnsClientFromApns2(as.Apns2Client()),
+		ApnsTopic:  "com.example.app",
+	}
+	n := &push.Notification{Title: "title", Body: "body", Link: "https://example.com/news/1", Data: map[string]string{"id": "1"}}
+	devices := []*push.Device{
+		{Platform: push.PlatformWebPush, Subscription: ws.Subscription(push.AES128GCM)},
+		{Platform: push.PlatformApns, Token: "apns"},
+		// fcm client is not set.
+		{Platform: push.PlatformFcm, Token: "fcm"},
+		{Platform: push.PlatformWebPush},
+		nil,
+	}
+	report, err := r.Notify(context.Background(), n, devices)
+
+	nerr, ok := err.(*push.NotifyError)
+	if !ok {
+		t.Fatalf("error is %v", err)
+	}
+	if len(nerr.Errors) != 3 || !strings.Contains(err.Error(), "fcm client is not set") {
+		t.Errorf("error is %v", err)
+	}
+	if !report.Results[0].Sent || !report.Results[1].Sent || report.Results[2].Err == nil || report.Results[3].Err == nil || report.Results[4].Err == nil {
+		t.Errorf("results are %+v %+v %+v %+v %+v", report.Results[0], report.Results[1], report.Results[2], report.Results[3], report.Results[4])
+	}
+
+	var webpush struct {
+		Link string `json:"link"`
+	}
+	if received := ws.Received(); len(received) != 1 {
+		t.Errorf("web push received %d notifications", len(received))
+	} else if err := json.Unmarshal(received[0].Payload, &webpush); err != nil || webpush.Link != n.Link {
+		t.Errorf("web push payload is %s", received[0].Payload)
+	}
+
+	var apns struct {
+		Link string `json:"link"`
+		ID   string `json:"id"`
+	}
+	if received := as.Received(); len(received) != 1 {
+		t.Errorf("apns received %d notifications", len(received))
+	} else if err := json.Unmarshal(received[0].Payload, &apns); err != nil || apns.Link != n.Link || apns.ID != "1" {
+		t.Errorf("apns payload is %s", received[0].Payload)
+	} else if topic := received[0].Header.Get("apns-topic"); topic != "com.example.app" {
+		t.Errorf("apns topic is %s", topic)
+	}
+
+	devices = devices[:2]
+	if _, err := r.Notify(context.Background(), n, devices); err != nil {
+		t.Errorf("error of successful notify is %v", err)
+	}
+}
+
+func TestDefaultRendererFcmLink(t *testing.T) {
+	n := &push.Notification{Title: "title", Link: "https://example.com/", Data: map[string]string{"id": "1"}}
+	m, err := (&push.DefaultRenderer{}).Fcm(n, &push.Device{Platform: push.PlatformFcm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Webpush == nil || m.Webpush.FcmOptions.Link != n.Link {
+		t.Errorf("webpush config is %+v", m.Webpush)
+	}
+	if m.Data["link"] != n.Link || m.Data["id"] != "1" {
+		t.Errorf("data is %v", m.Data)
+	}
+	if _, ok := n.Data["link"]; ok {
+		t.Error("data of notification is modified")
+	}
+}
+
+// localeRenderer renders web push payload per locale, so devices of each locale are sent separately.
+type localeRenderer struct {
+	push.DefaultRenderer
+}
+
+func (l *localeRenderer) WebPush(n *push.Notification, d *push.Device) ([]byte, error) {
+	return []byte(d.Locale + ":" + n.Title), nil
+}
+
+// deadlineTransport records deadline of requests and blocks until it.
+type deadlineTransport struct {
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (d *deadlineTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	deadline, _ := r.Context().Deadline()
+	d.mu.Lock()
+	d.deadlines = append(d.deadlines, deadline)
+	d.mu.Unlock()
+	<-r.Context().Done()
+	return nil, r.Context().Err()
+}
+
+func TestRoutingNotifierNotifyTimeout(t *testing.T) {
+	ws, err := testutil.NewFakeWebPushServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	tr := &deadlineTransport{}
+	r := &push.RoutingNotifier{
+		HTTPClient: &http.Client{Transport: tr},
+		Renderer:   &localeRenderer{},
+		Options:    []push.Option{push.WithTimeout(50 * time.Millisecond), push.WithRetryPolicy(&push.RetryPolicy{MaxAttempts: 1})},
+	}
+	devices := []*push.Device{
+		{Platform: push.PlatformWebPush, Subscription: ws.Subscription(push.AES128GCM), Locale: "en"},
+		{Platform: push.PlatformWebPush, Subscription: ws.Subscription(push.AES128GCM), Locale: "ja"},
+	}
+	report, err := r.Notify(context.Background(), &push.Notification{Title: "title"}, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range report.Results {
+		if res.Sent || res.Err == nil {
+			t.Errorf("%d: result is %+v", i, res)
+		}
+	}
+	if len(tr.deadlines) != 1 {
+		t.Errorf("%d groups are sent before deadline, deadlines are %v", len(tr.deadlines), tr.deadlines)
+	}
+}
@@ -0,0 +1,148 @@
+package push
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var _ Observer = (*ExpvarObserver)(nil)
+
+// Observer observes delivery to each recipient.
+//
+// Methods are called concurrently from workers.
+type Observer interface {
+	// OnAttempt is called before each request to push service.
+	OnAttempt(ctx context.Context, p Platform, res *Result)
+	// OnSuccess is called when recipient is sent, latency is duration of the last request.
+	OnSuccess(ctx context.Context, p Platform, res *Result, latency time.Duration)
+	// OnFailure is called when recipient finally fails, latency is duration of the last request.
+	//
+	// It is also called with context error for recipient which has not been started until deadline,
+	// then Attempts of result and latency are zero.
+	OnFailure(ctx context.Context, p Platform, res *Result, err error, latency time.Duration)
+	// OnRetry is called when failed request is retried after wait.
+	OnRetry(ctx context.Context, p Platform, res *Result, err error, wait time.Duration)
+}
+
+// DefaultLatencyBuckets is upper bounds of latency histogram buckets.
+var DefaultLatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// ExpvarObserver exports counters and latency histograms per platform with expvar.
+//
+// Exported map has attempts, successes, failures and retries counters keyed by "<platform>.<counter>",
+// and latency histograms keyed by "<platform>.latency".
+type ExpvarObserver struct {
+	m       *expvar.Map
+	buckets []time.Duration
+
+	mu         sync.Mutex
+	histograms map[Platform]*histogram
+}
+
+// NewExpvarObserver return new observer published as expvar map of name.
+//
+// Like expvar.NewMap, it panics if name is already published.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	return &ExpvarObserver{
+		m:          expvar.NewMap(name),
+		buckets:    DefaultLatencyBuckets,
+		histograms: make(map[Platform]*histogram),
+	}
+}
+
+// OnAttempt counts attempt.
+func (e *ExpvarObserver) OnAttempt(ctx context.Context, p Platform, res *Result) {
+	e.m.Add(p.String()+".attempts", 1)
+}
+
+// OnSuccess counts success and observes latency.
+func (e *ExpvarObserver) OnSuccess(ctx context.Context, p Platform, res *Result, latency time.Duration) {
+	e.m.Add(p.String()+".successes", 1)
+	e.histogram(p).observe(latency)
+}
+
+// OnFailure counts failure and observes latency if request was sent.
+func (e *ExpvarObserver) OnFailure(ctx context.Context, p Platform, res *Result, err error, latency time.Duration) {
+	e.m.Add(p.String()+".failures", 1)
+	if res.Attempts > 0 {
+		e.histogram(p).observe(latency)
+	}
+}
+
+// OnRetry counts retry.
+func (e *ExpvarObserver) OnRetry(ctx context.Context, p Platform, res *Result, err error, wait time.Duration) {
+	e.m.Add(p.String()+".retries", 1)
+}
+
+func (e *ExpvarObserver) histogram(p Platform) *histogram {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h, ok := e.histograms[p]
+	if !ok {
+		h = newHistogram(e.buckets)
+		e.histograms[p] = h
+		e.m.Set(p.String()+".latency", h)
+	}
+	return h
+}
+
+// histogram is cumulative histogram of latency, it implements expvar.Var.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []time.Duration
+	counts  []int64
+	count   int64
+	sum     time.Duration
+}
+
+func newHistogram(buckets []time.Duration) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if d <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+// String return histogram as json, bucket key is upper bound in milliseconds.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[string]int64, len(h.buckets)+1)
+	for i, b := range h.buckets {
+		buckets[durationMillis(b)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.count
+	b, _ := json.Marshal(map[string]interface{}{
+		"buckets": buckets,
+		"count":   h.count,
+		"sum_ms":  float64(h.sum) / float64(time.Millisecond),
+	})
+	return string(b)
+}
+
+func durationMillis(d time.Duration) string {
+	b, _ := json.Marshal(float64(d) / float64(time.Millisecond))
+	return string(b)
+}
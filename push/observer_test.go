@@ -0,0 +1,118 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// blockWorker blocks until context is done and release is closed.
+type blockWorker struct {
+	started chan struct{}
+	release chan struct{}
+	res     *Result
+}
+
+func (b *blockWorker) work(ctx context.Context) error {
+	b.res.Attempts++
+	close(b.started)
+	<-ctx.Done()
+	<-b.release
+	return ctx.Err()
+}
+
+func (b *blockWorker) result() *Result {
+	return b.res
+}
+
+func (b *blockWorker) host() string {
+	return ""
+}
+
+func (b *blockWorker) platform() Platform {
+	return PlatformFcm
+}
+
+// notifyObserver notifies failures to channel.
+type notifyObserver struct {
+	*ExpvarObserver
+	failed chan *Result
+}
+
+func (n *notifyObserver) OnFailure(ctx context.Context, p Platform, res *Result, err error, latency time.Duration) {
+	n.ExpvarObserver.OnFailure(ctx, p, res, err, latency)
+	n.failed <- res
+}
+
+func TestExpvarObserver(t *testing.T) {
+	// map is not published, so test can run more than once.
+	e := &ExpvarObserver{m: new(expvar.Map).Init(), buckets: DefaultLatencyBuckets, histograms: make(map[Platform]*histogram)}
+	obs := &notifyObserver{e, make(chan *Result, 10)}
+	var requests int32
+	block := &blockWorker{make(chan struct{}), make(chan struct{}), &Result{}}
+	wrk := []worker{
+		&sleepWorker{&requests, nil, &Result{}},
+		&sleepWorker{&requests, errors.New("network error"), &Result{}},
+		block,
+		// not started, because the only worker is blocked until cancel.
+		&sleepWorker{&requests, nil, &Result{}},
+		&sleepWorker{&requests, nil, &Result{}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *Report)
+	go func() {
+		done <- runWorker(ctx, wrk, newOptions([]Option{
+			WithMaxConcurrency(1),
+			WithObserver(obs),
+			WithRetryPolicy(&RetryPolicy{MaxAttempts: 2, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 1}),
+		}))
+	}()
+	<-block.started
+	cancel()
+	// failed worker and two workers not started.
+	for i := 0; i < 3; i++ {
+		<-obs.failed
+	}
+	close(block.release)
+	report := <-done
+	<-obs.failed
+
+	if report.SuccessCount() != 1 {
+		t.Errorf("success count is %d", report.SuccessCount())
+	}
+	for _, res := range report.Results[3:] {
+		if res.Err != context.Canceled || res.Attempts != 0 {
+			t.Errorf("result of not started worker is %+v", res)
+		}
+	}
+
+	want := map[string]string{
+		"fcm.attempts":  "4",
+		"fcm.successes": "1",
+		"fcm.failures":  "4",
+		"fcm.retries":   "1",
+	}
+	for k, v := range want {
+		if got := obs.m.Get(k); got == nil || got.String() != v {
+			t.Errorf("%s is %v, want %s", k, got, v)
+		}
+	}
+	var h struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.Unmarshal([]byte(obs.m.Get("fcm.latency").String()), &h); err != nil {
+		t.Fatal(err)
+	}
+	// latency of workers not started is not observed.
+	if h.Count != 3 {
+		t.Errorf("latency count is %d", h.Count)
+	}
+	if requests != 3 {
+		t.Errorf("requests are %d", requests)
+	}
+}
@@ -0,0 +1,125 @@
+package push
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Option is option of sending notification.
+type Option func(*options)
+
+type options struct {
+	invalid InvalidRecipientHandler
+	vapid   *vapid
+
+	recordSize int
+	padding    int
+
+	maxConcurrency int
+	limiter        *hostLimiter
+	timeout        time.Duration
+
+	retry *RetryPolicy
+
+	ttl     *time.Duration
+	urgency Urgency
+	topic   string
+
+	observer Observer
+
+	idempotencyKey string
+	dedupe         DedupeStore
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{retry: DefaultRetryPolicy}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithInvalidRecipientHandler set handler called with recipient which is no longer valid.
+func WithInvalidRecipientHandler(h InvalidRecipientHandler) Option {
+	return func(o *options) {
+		o.invalid = h
+	}
+}
+
+// WithVAPID set VAPID key pair and subject used to authenticate web push.
+//
+// subject is contact of application server, mailto: or https: url.
+// Server key is not sent if VAPID is set.
+func WithVAPID(keys *VAPIDKeys, subject string) Option {
+	return func(o *options) {
+		o.vapid = newVAPID(keys, subject)
+	}
+}
+
+// WithRecordSize set record size of encrypted web push payload.
+//
+// Push services accept only one record, so it must be larger than payload.
+func WithRecordSize(rs int) Option {
+	return func(o *options) {
+		o.recordSize = rs
+	}
+}
+
+// WithPadding set length of padding added to web push payload to hide its length.
+func WithPadding(n int) Option {
+	return func(o *options) {
+		o.padding = n
+	}
+}
+
+// WithMaxConcurrency set max number of concurrent requests to push services.
+//
+// DefaultMaxConcurrency is used if it is not set.
+func WithMaxConcurrency(n int) Option {
+	return func(o *options) {
+		o.maxConcurrency = n
+	}
+}
+
+// WithHostRateLimit limits requests per second to each push service host.
+func WithHostRateLimit(limit rate.Limit, burst int) Option {
+	return func(o *options) {
+		o.limiter = newHostLimiter(limit, burst)
+	}
+}
+
+// WithTimeout set deadline of whole send.
+//
+// Recipients which have not been sent until deadline fail with context error.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithRetryPolicy set retry policy of delivery to each recipient, DefaultRetryPolicy is used if p is nil.
+func WithRetryPolicy(p *RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = p
+	}
+}
+
+// WithObserver set observer of delivery to each recipient.
+func WithObserver(obs Observer) Option {
+	return func(o *options) {
+		o.observer = obs
+	}
+}
+
+// WithIdempotencyKey set key identifying notification and store of recipients already sent with it.
+//
+// Recipient is claimed in store before it is sent, claim is confirmed if it is sent and released if it is not sent.
+// Recipients already claimed with the same key are skipped, so replayed or concurrent send does not deliver duplicates.
+// If process dies before claimed recipient is sent, replay skips it until pending expiration of store passes.
+func WithIdempotencyKey(key string, store DedupeStore) Option {
+	return func(o *options) {
+		o.idempotencyKey = key
+		o.dedupe = store
+	}
+}
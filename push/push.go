@@ -2,18 +2,16 @@ package push
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/koichirokamoto/gko/log"
-	"github.com/koichirokamoto/webpush"
-	"github.com/sideshow/apns2"
 	"golang.org/x/net/context"
-	"google.golang.org/api/gensupport"
 )
 
 const (
@@ -21,119 +19,150 @@ const (
 	gcmURL = "https://android.googleapis.com/gcm/send"
 )
 
-type worker interface {
-	work() error
-}
-
-func runWorker(ctx context.Context, wrk <-chan worker) {
-	var wg sync.WaitGroup
-	for w := range wrk {
-		wg.Add(1)
-		go func(w worker) {
-			defer wg.Done()
-			err := retry(w.work, gensupport.DefaultBackoffStrategy())
-			if err != nil {
-				log.DefaultLogger.Log(ctx, log.Error, err.Error())
-			}
-		}(w)
-	}
-	wg.Wait()
-}
-
 // FcmSubscription is fcm subscription.
 type FcmSubscription struct {
 	Endpoint string
 	Key      string
 	Auth     string
+	// Encoding is content encoding of payload, aesgcm is used if it is empty.
+	Encoding ContentEncoding
+}
+
+func (f *FcmSubscription) encoding() ContentEncoding {
+	if f.Encoding == "" {
+		return AESGCM
+	}
+	return f.Encoding
 }
 
 type fcmWorker struct {
-	ctx     context.Context
 	c       *http.Client
 	key     string
 	sub     *FcmSubscription
 	payload []byte
+	res     *Result
+	o       *options
 }
 
 // SendFcmNotification push fcm notification to user.
-func SendFcmNotification(ctx context.Context, c *http.Client, key string, subs []*FcmSubscription, payload []byte) {
-	in := make(chan worker)
-	go func() {
-		for _, sub := range subs {
-			in <- &fcmWorker{ctx, c, key, sub, payload}
+//
+// Returned report contains delivery result of each subscription.
+// If options are invalid, all subscriptions fail without sending.
+func SendFcmNotification(ctx context.Context, c *http.Client, key string, subs []*FcmSubscription, payload []byte, opts ...Option) *Report {
+	o := newOptions(opts)
+	if err := o.validateWebPushHeaders(); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		report := &Report{Results: make([]*Result, len(subs))}
+		for i, sub := range subs {
+			report.Results[i] = &Result{Subscription: sub, Err: permanent(err)}
 		}
-		close(in)
-	}()
-
-	runWorker(ctx, in)
-}
-
-func (f *fcmWorker) work() error {
-	encryption, err := webpush.Encryption(f.sub.Key, f.sub.Auth, f.payload, 0)
-	if err != nil {
-		log.DefaultLogger.Log(f.ctx, log.Error, err.Error())
-		return err
+		return report
 	}
 
-	endpoint := strings.Replace(f.sub.Endpoint, gcmURL, fcmURL, 1)
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(encryption.Payload))
-	if err != nil {
-		log.DefaultLogger.Log(f.ctx, log.Error, err.Error())
-		return err
+	wrk := make([]worker, len(subs))
+	for i, sub := range subs {
+		wrk[i] = &fcmWorker{c, key, sub, payload, &Result{Subscription: sub}, o}
 	}
-	defer req.Body.Close()
-	req.Header.Set("Authorization", "key="+f.key)
-	req.Header.Set("Encryption", "salt="+base64.URLEncoding.EncodeToString(encryption.Salt))
-	req.Header.Set("Crypto-Key", "dh="+base64.URLEncoding.EncodeToString(encryption.PublickKey))
-	req.Header.Set("Content-Encoding", "aesgcm")
-	req.ContentLength = int64(len(encryption.Payload))
-	res, err := f.c.Do(req)
-	if err != nil {
-		log.DefaultLogger.Log(f.ctx, log.Error, err.Error())
-		return err
-	}
-	res.Body.Close()
-	return nil
+
+	return runWorker(ctx, wrk, o)
 }
 
-type apnsWorker struct {
-	ctx         context.Context
-	c           *apns2.Client
-	deviceToken string
-	payload     []byte
+func (f *fcmWorker) result() *Result {
+	return f.res
 }
 
-// SendApns2Notification send apns2 notification.
-func SendApns2Notification(ctx context.Context, cert tls.Certificate, deviceTokens []string, payload []byte) {
-	in := make(chan worker)
+func (f *fcmWorker) platform() Platform {
+	return PlatformWebPush
+}
+
+func (f *fcmWorker) host() string {
+	u, err := url.Parse(f.sub.Endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
 
-	go func() {
-		c := apns2.NewClient(cert)
-		for _, d := range deviceTokens {
-			in <- &apnsWorker{ctx, c, d, payload}
+func (f *fcmWorker) setHeaders(req *http.Request, endpoint string, e *encrypted) error {
+	var token string
+	if f.o.vapid != nil {
+		var err error
+		token, err = f.o.vapid.token(endpoint)
+		if err != nil {
+			return err
 		}
-		close(in)
-	}()
+	}
 
-	runWorker(ctx, in)
+	req.Header.Set("Content-Encoding", string(e.encoding))
+	f.o.setWebPushHeaders(req.Header)
+	switch e.encoding {
+	case AES128GCM:
+		// salt, record size and public key are in header block of body.
+		if f.o.vapid != nil {
+			req.Header.Set("Authorization", "vapid t="+token+", k="+f.o.vapid.keys.PublicKey())
+		} else {
+			req.Header.Set("Authorization", "key="+f.key)
+		}
+	case AESGCM:
+		encryption := "salt=" + base64.RawURLEncoding.EncodeToString(e.salt)
+		if e.rs != DefaultRecordSize {
+			encryption += ";rs=" + strconv.Itoa(e.rs)
+		}
+		cryptoKey := "dh=" + base64.RawURLEncoding.EncodeToString(e.publicKey)
+		if f.o.vapid != nil {
+			req.Header.Set("Authorization", "WebPush "+token)
+			cryptoKey += ";p256ecdsa=" + f.o.vapid.keys.PublicKey()
+		} else {
+			req.Header.Set("Authorization", "key="+f.key)
+		}
+		req.Header.Set("Encryption", encryption)
+		req.Header.Set("Crypto-Key", cryptoKey)
+	}
+	return nil
 }
 
-func (a *apnsWorker) work() error {
-	notification := &apns2.Notification{}
-	notification.DeviceToken = a.deviceToken
-	notification.Payload = a.payload
+func (f *fcmWorker) work(ctx context.Context) error {
+	f.res.Attempts++
+	encryption, err := encryptPayload(f.sub, f.payload, f.o.recordSize, f.o.padding)
+	if err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		return permanent(err)
+	}
 
-	res, err := a.c.Push(notification)
+	endpoint := strings.Replace(f.sub.Endpoint, gcmURL, fcmURL, 1)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(encryption.body))
 	if err != nil {
-		log.DefaultLogger.Log(a.ctx, log.Error, err.Error())
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		return permanent(err)
+	}
+	defer req.Body.Close()
+	req = req.WithContext(ctx)
+	if err := f.setHeaders(req, endpoint, encryption); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		return permanent(err)
+	}
+	req.ContentLength = int64(len(encryption.body))
+	res, err := f.c.Do(req)
+	if err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
 		return err
 	}
-
-	if !res.Sent() {
-		errMsg := fmt.Sprintf("not sent: %d %s %s", res.StatusCode, res.ApnsID, res.Reason)
-		log.DefaultLogger.Log(a.ctx, log.Error, errMsg)
-		return fmt.Errorf(errMsg)
+	defer res.Body.Close()
+
+	f.res.StatusCode = res.StatusCode
+	if 400 <= res.StatusCode {
+		msg, _ := ioutil.ReadAll(res.Body)
+		f.res.Reason = string(msg)
+		errMsg := fmt.Sprintf("not sent: %d %s %s", res.StatusCode, f.sub.Endpoint, msg)
+		log.DefaultLogger.Log(ctx, log.Error, "%s", errMsg)
+		f.res.Invalid = isInvalidSubscriptionStatus(res.StatusCode)
+		return &sendError{
+			msg:        errMsg,
+			retryable:  isRetryableStatus(res.StatusCode),
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
 	}
-
+	f.res.Sent = true
+	f.res.Reason = ""
 	return nil
 }
@@ -0,0 +1,107 @@
+package push_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/koichirokamoto/gko/push"
+	"github.com/koichirokamoto/gko/testutil"
+	"golang.org/x/net/context"
+)
+
+func TestSendFcmNotification(t *testing.T) {
+	s, err := testutil.NewFakeWebPushServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	keys, err := push.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs := []*push.FcmSubscription{
+		s.Subscription(push.AESGCM),
+		s.Subscription(push.AES128GCM),
+		s.Subscription(push.AES128GCM),
+	}
+	s.InjectError(subs[2], http.StatusGone, "gone", -1)
+
+	payload := []byte(`{"title":"hello"}`)
+	report := push.SendFcmNotification(context.Background(), s.Client(), "", subs, payload,
+		push.WithVAPID(keys, "mailto:test@example.com"), push.WithPadding(10), push.WithTopic("news"))
+
+	if n := report.SuccessCount(); n != 2 {
+		t.Errorf("success count is %d", n)
+	}
+	if res := report.Results[2]; res.Sent || !res.Invalid || res.StatusCode != http.StatusGone {
+		t.Errorf("result of gone subscription is %+v", res)
+	}
+
+	received := s.Received()
+	if len(received) != 2 {
+		t.Fatalf("received %d notifications", len(received))
+	}
+	for _, r := range received {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if !bytes.Equal(r.Payload, payload) {
+			t.Errorf("payload is %s", r.Payload)
+		}
+		if r.Header.Get("Topic") != "news" || r.Header.Get("TTL") != "" {
+			t.Errorf("header is %v", r.Header)
+		}
+		auth := r.Header.Get("Authorization")
+		switch push.ContentEncoding(r.Header.Get("Content-Encoding")) {
+		case push.AESGCM:
+			if !strings.HasPrefix(auth, "WebPush ") || !strings.Contains(r.Header.Get("Crypto-Key"), "p256ecdsa="+keys.PublicKey()) {
+				t.Errorf("aesgcm header is %v", r.Header)
+			}
+		case push.AES128GCM:
+			if !strings.HasPrefix(auth, "vapid t=") || !strings.HasSuffix(auth, "k="+keys.PublicKey()) {
+				t.Errorf("aes128gcm header is %v", r.Header)
+			}
+		}
+	}
+}
+
+func TestSendFcmNotificationInvalidSubscription(t *testing.T) {
+	s, err := testutil.NewFakeWebPushServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	subs := []*push.FcmSubscription{s.Subscription(push.AES128GCM), s.Subscription(push.AES128GCM)}
+	s.InjectError(subs[1], http.StatusGone, "gone", -1)
+
+	h := &recordingInvalidHandler{}
+	report := push.SendFcmNotification(context.Background(), s.Client(), "key", subs, []byte("hello"),
+		push.WithInvalidRecipientHandler(h))
+	if res := report.Results[1]; res.Sent || !res.Invalid || res.Attempts != 1 {
+		t.Errorf("result of gone subscription is %+v", res)
+	}
+	if len(h.subs) != 1 || h.subs[0] != subs[1] || len(h.tokens) != 0 {
+		t.Errorf("invalid subscriptions are %v, tokens are %v", h.subs, h.tokens)
+	}
+}
+
+func TestSendFcmNotificationInvalidTopic(t *testing.T) {
+	s, err := testutil.NewFakeWebPushServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	subs := []*push.FcmSubscription{s.Subscription(push.AES128GCM)}
+	report := push.SendFcmNotification(context.Background(), s.Client(), "key", subs, []byte("hello"), push.WithTopic("not valid topic"))
+	if res := report.Results[0]; res.Sent || res.Err == nil || res.Attempts != 0 {
+		t.Errorf("result is %+v", res)
+	}
+	if n := len(s.Received()); n != 0 {
+		t.Errorf("received %d notifications", n)
+	}
+}
@@ -0,0 +1,66 @@
+package push
+
+import "time"
+
+// Result is delivery result of one recipient.
+type Result struct {
+	// Subscription is recipient of web push, it is nil for apns and fcm.
+	Subscription *FcmSubscription
+	// DeviceToken is apns device token or fcm registration token, it is empty for web push.
+	DeviceToken string
+
+	// Sent is true if push service accepted notification.
+	Sent bool
+	// Skipped is true if recipient was already sent or is being sent with the same idempotency key.
+	//
+	// Sent is also true for skipped recipient.
+	Skipped bool
+	// StatusCode is last http status code returned by push service.
+	StatusCode int
+	// Reason is error reason returned by push service.
+	Reason string
+	// Attempts is number of requests sent to push service.
+	Attempts int
+	// Timestamp is time when apns confirmed device token is no longer valid.
+	//
+	// Device token registered after it is valid again.
+	Timestamp time.Time
+	// Invalid is true if push service answered recipient is no longer valid.
+	Invalid bool
+	// Err is last error occurred while sending.
+	Err error
+}
+
+// Report is delivery report of one send.
+//
+// Results has the same order as recipients.
+type Report struct {
+	Results []*Result
+}
+
+// SuccessCount return number of sent recipients.
+func (r *Report) SuccessCount() int {
+	var n int
+	for _, res := range r.Results {
+		if res.Sent {
+			n++
+		}
+	}
+	return n
+}
+
+// FailureCount return number of failed recipients.
+func (r *Report) FailureCount() int {
+	return len(r.Results) - r.SuccessCount()
+}
+
+// Failed return results which is not sent.
+func (r *Report) Failed() []*Result {
+	var failed []*Result
+	for _, res := range r.Results {
+		if !res.Sent {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
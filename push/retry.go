@@ -1,24 +1,124 @@
 package push
 
 import (
+	"math/rand"
+	"net/http"
+	"strconv"
 	"time"
 
-	"google.golang.org/api/gensupport"
+	"golang.org/x/net/context"
 )
 
-// Retry function with backoff.
+// DefaultRetryPolicy is retry policy used if it is not set.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:     5,
+	InitialInterval: 250 * time.Millisecond,
+	MaxInterval:     16 * time.Second,
+	Multiplier:      2,
+}
+
+// RetryPolicy is policy of retrying delivery to one recipient.
 //
-// It's reference google.golang.org/api/gensupport/retry.go
-func retry(f func() error, backoff gensupport.BackoffStrategy) error {
-	for {
+// Only network errors, 429 and 5xx responses are retried.
+// If push service answers Retry-After, wait until then instead of backoff interval.
+type RetryPolicy struct {
+	// MaxAttempts is max number of requests including first one, 1 means no retry.
+	MaxAttempts int
+	// InitialInterval is interval before first retry.
+	InitialInterval time.Duration
+	// MaxInterval is upper bound of interval.
+	MaxInterval time.Duration
+	// Multiplier is factor of interval increased at each retry.
+	Multiplier float64
+}
+
+// interval return backoff interval before retry of attempt with jitter.
+func (p *RetryPolicy) interval(attempt int) time.Duration {
+	d := float64(p.InitialInterval)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if p.MaxInterval > 0 && d > float64(p.MaxInterval) {
+			d = float64(p.MaxInterval)
+			break
+		}
+	}
+	if d < 2 {
+		return time.Duration(d)
+	}
+	half := int64(d) / 2
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// sendError is error answered by push service or error occurred before request.
+type sendError struct {
+	msg        string
+	retryable  bool
+	retryAfter time.Duration
+}
+
+func (e *sendError) Error() string {
+	return e.msg
+}
+
+// permanent return error which is never retried.
+func permanent(err error) error {
+	return &sendError{msg: err.Error()}
+}
+
+func isRetryable(err error) bool {
+	if e, ok := err.(*sendError); ok {
+		return e.retryable
+	}
+	// network error.
+	return err != context.Canceled && err != context.DeadlineExceeded
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || 500 <= code
+}
+
+// parseRetryAfter parses Retry-After header which is seconds or http date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(time.Now())
+	}
+	return 0
+}
+
+// retry calls f until it succeeds, error is not retryable, attempts reach max or context is done.
+//
+// onRetry is called with error and wait before each retry if it is non-nil.
+// DefaultRetryPolicy is used if p is nil.
+func retry(ctx context.Context, f func() error, p *RetryPolicy, onRetry func(error, time.Duration)) error {
+	if p == nil {
+		p = DefaultRetryPolicy
+	}
+	for attempt := 1; ; attempt++ {
 		err := f()
-		pause, retry := backoff.Pause()
-		if !retry {
+		if err == nil || !isRetryable(err) || attempt >= p.MaxAttempts || ctx.Err() != nil {
 			return err
 		}
 
+		pause := p.interval(attempt)
+		if e, ok := err.(*sendError); ok && pause < e.retryAfter {
+			pause = e.retryAfter
+		}
+		if onRetry != nil {
+			onRetry(err, pause)
+		}
+
+		t := time.NewTimer(pause)
 		select {
-		case <-time.After(pause):
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
 		}
 	}
 }
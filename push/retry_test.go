@@ -0,0 +1,104 @@
+package push
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRetry(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, Multiplier: 2}
+
+	tests := []struct {
+		name string
+		errs []error
+		want int
+	}{
+		{"success", []error{nil}, 1},
+		{"success after network error", []error{errors.New("network"), nil}, 2},
+		{"not retryable", []error{&sendError{msg: "400"}}, 1},
+		{"retryable status", []error{&sendError{msg: "503", retryable: true}, nil}, 2},
+		{"max attempts", []error{errors.New("1"), errors.New("2"), errors.New("3"), nil}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			err := retry(context.Background(), func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			}, p, nil)
+			if calls != tt.want {
+				t.Errorf("called %d times, want %d", calls, tt.want)
+			}
+			if want := tt.errs[calls-1]; err != want {
+				t.Errorf("got %v, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestRetryNilPolicy(t *testing.T) {
+	var calls int
+	err := retry(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return &sendError{msg: "503", retryable: true}
+		}
+		return nil
+	}, nil, nil)
+	if err != nil || calls != 2 {
+		t.Errorf("called %d times, error is %v", calls, err)
+	}
+
+	var requests int32
+	w := &sleepWorker{&requests, nil, &Result{}}
+	report := runWorker(context.Background(), []worker{w}, newOptions([]Option{WithRetryPolicy(nil)}))
+	if report.SuccessCount() != 1 || requests != 1 {
+		t.Errorf("result is %+v", w.res)
+	}
+}
+
+func TestRetryContextCanceled(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 10, InitialInterval: time.Hour, Multiplier: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls int
+	done := make(chan error)
+	go func() {
+		done <- retry(ctx, func() error {
+			calls++
+			return errors.New("network")
+		}, p, nil)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("error is nil")
+		}
+		if calls != 1 {
+			t.Errorf("called %d times, want 1", calls)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retry is not aborted")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("120"); d != 2*time.Minute {
+		t.Errorf("got %s, want 2m", d)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d < 59*time.Minute || time.Hour < d {
+		t.Errorf("got %s, want about 1h", d)
+	}
+	if d := parseRetryAfter(""); d != 0 {
+		t.Errorf("got %s, want 0", d)
+	}
+}
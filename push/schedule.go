@@ -0,0 +1,139 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/koichirokamoto/gko/cloud/gcp/gae"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// maxTaskETA is max duration from now to ETA of task accepted by task queue.
+const maxTaskETA = 30 * 24 * time.Hour
+
+// QuietHours is daily window of recipient local time in which notification is not delivered.
+//
+// Start and End are offsets from local midnight, window wraps midnight if Start is after End.
+// Window is empty if Start equals End.
+type QuietHours struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// ParseQuietHours return quiet hours of IANA time zone name, start and end are "15:04" format.
+func ParseQuietHours(zone, start, end string) (*QuietHours, error) {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseClock(start)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseClock(end)
+	if err != nil {
+		return nil, err
+	}
+	return &QuietHours{Start: s, End: e, Location: loc}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Defer return t if it is out of quiet hours, otherwise return end of quiet hours.
+func (q *QuietHours) Defer(t time.Time) time.Time {
+	if q == nil || q.Start == q.End {
+		return t
+	}
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	local := t.In(loc)
+	y, m, d := local.Date()
+	clock := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second + time.Duration(local.Nanosecond())
+	end := func(day int) time.Time {
+		// clock of end is rebuilt with time.Date so that it is kept across daylight saving time.
+		return time.Date(y, m, day, int(q.End/time.Hour), int(q.End%time.Hour/time.Minute), 0, 0, loc)
+	}
+
+	if q.Start < q.End {
+		if q.Start <= clock && clock < q.End {
+			return end(d)
+		}
+		return t
+	}
+	if clock >= q.Start {
+		return end(d + 1)
+	}
+	if clock < q.End {
+		return end(d)
+	}
+	return t
+}
+
+// ScheduledRecipient is web push recipient of scheduled notification.
+type ScheduledRecipient struct {
+	Subscription *FcmSubscription
+	// QuietHours is quiet hours of recipient, notification is sent at any time if it is nil.
+	QuietHours *QuietHours
+}
+
+// ScheduleFcmNotification enqueues web push notification sent at time at.
+//
+// Delivery to recipient whose quiet hours contain at is deferred to end of its quiet hours.
+// Recipients of the same delivery time are split into tasks of chunk size like EnqueueFcmNotification,
+// and each task has delivery time as its ETA.
+// Error is returned without enqueueing if delivery time of some recipient is more than 30 days later,
+// which task queue does not accept.
+func ScheduleFcmNotification(ctx context.Context, q gae.Queue, p gae.Path, at time.Time, recipients []*ScheduledRecipient, payload []byte, chunkSize int) ([]*taskqueue.Task, error) {
+	tasks, err := newScheduledTasks(p, time.Now(), at, recipients, payload, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return addTasks(ctx, q, tasks)
+}
+
+func newScheduledTasks(p gae.Path, now, at time.Time, recipients []*ScheduledRecipient, payload []byte, chunkSize int) ([]*taskqueue.Task, error) {
+	groups := make(map[time.Time][]*FcmSubscription)
+	for _, r := range recipients {
+		if r.Subscription == nil {
+			return nil, errors.New("scheduled recipient has no subscription")
+		}
+		eta := r.QuietHours.Defer(at).UTC()
+		if eta.Sub(now) > maxTaskETA {
+			return nil, fmt.Errorf("delivery time %v to %s is more than %v later", eta, r.Subscription.Endpoint, maxTaskETA)
+		}
+		groups[eta] = append(groups[eta], r.Subscription)
+	}
+
+	etas := make([]time.Time, 0, len(groups))
+	for eta := range groups {
+		etas = append(etas, eta)
+	}
+	sort.Slice(etas, func(i, j int) bool { return etas[i].Before(etas[j]) })
+
+	var tasks []*taskqueue.Task
+	for _, eta := range etas {
+		t, err := newFcmTasks(p, groups[eta], payload, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range t {
+			task.ETA = eta
+		}
+		tasks = append(tasks, t...)
+	}
+	return tasks, nil
+}
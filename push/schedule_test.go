@@ -0,0 +1,77 @@
+package push
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursDefer(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	night := &QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour, Location: tokyo}
+	lunch := &QuietHours{Start: 12 * time.Hour, End: 13 * time.Hour, Location: tokyo}
+
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2017, 3, day, hour, min, 0, 0, tokyo)
+	}
+	tests := []struct {
+		q    *QuietHours
+		t    time.Time
+		want time.Time
+	}{
+		{night, at(1, 21, 59), at(1, 21, 59)},
+		{night, at(1, 22, 0), at(2, 7, 0)},
+		{night, at(1, 23, 30), at(2, 7, 0)},
+		{night, at(2, 3, 0), at(2, 7, 0)},
+		{night, at(2, 7, 0), at(2, 7, 0)},
+		{lunch, at(1, 12, 30), at(1, 13, 0)},
+		{lunch, at(1, 13, 0), at(1, 13, 0)},
+		{nil, at(1, 23, 0), at(1, 23, 0)},
+		// 13:30 UTC is 22:30 in Tokyo.
+		{night, time.Date(2017, 3, 1, 13, 30, 0, 0, time.UTC), at(2, 7, 0)},
+	}
+	for _, tt := range tests {
+		if got := tt.q.Defer(tt.t); !got.Equal(tt.want) {
+			t.Errorf("%v: deferred to %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestNewScheduledTasks(t *testing.T) {
+	night, err := ParseQuietHours("UTC", "22:00", "07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2017, 3, 1, 23, 0, 0, 0, time.UTC)
+	recipients := []*ScheduledRecipient{
+		{Subscription: &FcmSubscription{Endpoint: "a"}},
+		{Subscription: &FcmSubscription{Endpoint: "b"}, QuietHours: night},
+		{Subscription: &FcmSubscription{Endpoint: "c"}},
+	}
+
+	now := at.Add(-time.Hour)
+	tasks, err := newScheduledTasks("/push", now, at, recipients, []byte("payload"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("tasks are %d", len(tasks))
+	}
+	if !tasks[0].ETA.Equal(at) || !tasks[1].ETA.Equal(time.Date(2017, 3, 2, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("etas are %v and %v", tasks[0].ETA, tasks[1].ETA)
+	}
+
+	// at is within 30 days, but quiet hours defer it beyond.
+	now = at.Add(-30*24*time.Hour + time.Hour)
+	if _, err := newScheduledTasks("/push", now, at, recipients, []byte("payload"), 0); err == nil {
+		t.Error("task deferred beyond max eta is created")
+	}
+	if _, err := newScheduledTasks("/push", now, at, recipients[:1], []byte("payload"), 0); err != nil {
+		t.Errorf("task within max eta is not created: %v", err)
+	}
+	if _, err := newScheduledTasks("/push", at.AddDate(0, -2, 0), at, recipients[:1], []byte("payload"), 0); err == nil {
+		t.Error("task of far future is created")
+	}
+}
@@ -0,0 +1,179 @@
+package push
+
+import (
+	"sync"
+	"time"
+
+	"github.com/koichirokamoto/gko/log"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// DefaultMaxConcurrency is max number of concurrent requests used if it is not set.
+const DefaultMaxConcurrency = 100
+
+type worker interface {
+	work(context.Context) error
+	result() *Result
+	// host is host name of push service, requests are rate limited per host.
+	host() string
+	platform() Platform
+}
+
+// hostLimiter holds rate limiter per host.
+type hostLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newHostLimiter(limit rate.Limit, burst int) *hostLimiter {
+	return &hostLimiter{limit: limit, burst: burst, limiters: make(map[string]*rate.Limiter)}
+}
+
+func (h *hostLimiter) wait(ctx context.Context, host string) error {
+	h.mu.Lock()
+	l, ok := h.limiters[host]
+	if !ok {
+		l = rate.NewLimiter(h.limit, h.burst)
+		h.limiters[host] = l
+	}
+	h.mu.Unlock()
+	return l.Wait(ctx)
+}
+
+// runWorker runs workers with at most max concurrency workers at once.
+//
+// Workers which have not been started until deadline fail with context error.
+func runWorker(ctx context.Context, wrk []worker, o *options) *Report {
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	n := o.maxConcurrency
+	if n <= 0 {
+		n = DefaultMaxConcurrency
+	}
+	if n > len(wrk) {
+		n = len(wrk)
+	}
+
+	in := make(chan worker)
+	go func() {
+		defer close(in)
+		for _, w := range wrk {
+			select {
+			case in <- w:
+			case <-ctx.Done():
+				notStarted(ctx, w, o)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range in {
+				// worker received together with deadline is not started either.
+				if ctx.Err() != nil {
+					notStarted(ctx, w, o)
+					continue
+				}
+				runOne(ctx, w, o)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Results: make([]*Result, len(wrk))}
+	for i, w := range wrk {
+		report.Results[i] = w.result()
+	}
+	return report
+}
+
+// notStarted fails worker which is not started until deadline with context error.
+func notStarted(ctx context.Context, w worker, o *options) {
+	w.result().Err = ctx.Err()
+	if o.observer != nil {
+		o.observer.OnFailure(ctx, w.platform(), w.result(), ctx.Err(), 0)
+	}
+}
+
+func runOne(ctx context.Context, w worker, o *options) {
+	var key string
+	if o.dedupe != nil && o.idempotencyKey != "" {
+		key = dedupeKey(o.idempotencyKey, w.result())
+		claimed, err := o.dedupe.Claim(ctx, key)
+		if err != nil {
+			// sending duplicate is better than losing notification.
+			log.DefaultLogger.Log(ctx, log.Warning, "%v", err)
+			key = ""
+		} else if !claimed {
+			w.result().Sent = true
+			w.result().Skipped = true
+			return
+		}
+	}
+
+	var latency time.Duration
+	err := retry(ctx, func() error {
+		if o.limiter != nil {
+			if err := o.limiter.wait(ctx, w.host()); err != nil {
+				return permanent(err)
+			}
+		}
+		if o.observer != nil {
+			o.observer.OnAttempt(ctx, w.platform(), w.result())
+		}
+		start := time.Now()
+		err := w.work(ctx)
+		latency = time.Since(start)
+		return err
+	}, o.retry, func(err error, wait time.Duration) {
+		if o.observer != nil {
+			o.observer.OnRetry(ctx, w.platform(), w.result(), err, wait)
+		}
+	})
+	if err != nil {
+		w.result().Err = err
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		if o.observer != nil {
+			o.observer.OnFailure(ctx, w.platform(), w.result(), err, latency)
+		}
+		if key != "" {
+			// release claim so that replayed send can deliver it.
+			if err := o.dedupe.Release(ctx, key); err != nil {
+				log.DefaultLogger.Log(ctx, log.Warning, "%v", err)
+			}
+		}
+	} else {
+		if key != "" {
+			// recipient is remembered for full expiration once it is sent.
+			if err := o.dedupe.Confirm(ctx, key); err != nil {
+				log.DefaultLogger.Log(ctx, log.Warning, "%v", err)
+			}
+		}
+		if o.observer != nil {
+			o.observer.OnSuccess(ctx, w.platform(), w.result(), latency)
+		}
+	}
+	if w.result().Invalid && o.invalid != nil {
+		if err := handleInvalidRecipient(ctx, o.invalid, w.result()); err != nil {
+			log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		}
+	}
+}
+
+func handleInvalidRecipient(ctx context.Context, h InvalidRecipientHandler, res *Result) error {
+	if res.Subscription != nil {
+		return h.InvalidSubscription(ctx, res.Subscription)
+	}
+	return h.InvalidDeviceToken(ctx, res.DeviceToken)
+}
@@ -0,0 +1,133 @@
+package push
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// countWorker counts requests in flight and records start time of its request.
+type countWorker struct {
+	inFlight *int32
+	max      *int32
+	h        string
+	start    time.Time
+	res      *Result
+}
+
+func (c *countWorker) work(ctx context.Context) error {
+	c.res.Attempts++
+	c.start = time.Now()
+	n := atomic.AddInt32(c.inFlight, 1)
+	defer atomic.AddInt32(c.inFlight, -1)
+	for {
+		m := atomic.LoadInt32(c.max)
+		if n <= m || atomic.CompareAndSwapInt32(c.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.res.Sent = true
+	return nil
+}
+
+func (c *countWorker) result() *Result {
+	return c.res
+}
+
+func (c *countWorker) host() string {
+	return c.h
+}
+
+func (c *countWorker) platform() Platform {
+	return PlatformWebPush
+}
+
+func newCountWorkers(n int, hosts ...string) ([]worker, *int32) {
+	var inFlight, max int32
+	wrk := make([]worker, n)
+	for i := range wrk {
+		wrk[i] = &countWorker{inFlight: &inFlight, max: &max, h: hosts[i%len(hosts)], res: &Result{}}
+	}
+	return wrk, &max
+}
+
+func TestRunWorkerMaxConcurrency(t *testing.T) {
+	for _, n := range []int{1, 3, 10} {
+		wrk, max := newCountWorkers(30, "push.example.com")
+		report := runWorker(context.Background(), wrk, newOptions([]Option{WithMaxConcurrency(n)}))
+		if c := report.SuccessCount(); c != len(wrk) {
+			t.Errorf("%d: success count is %d", n, c)
+		}
+		if m := atomic.LoadInt32(max); m > int32(n) || m == 0 {
+			t.Errorf("%d: max concurrency is %d", n, m)
+		}
+	}
+}
+
+func TestRunWorkerHostRateLimit(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	wrk, _ := newCountWorkers(6, "a.example.com", "b.example.com")
+	runWorker(context.Background(), wrk, newOptions([]Option{WithHostRateLimit(rate.Every(interval), 1)}))
+
+	starts := make(map[string][]time.Time)
+	for _, w := range wrk {
+		c := w.(*countWorker)
+		if !c.res.Sent {
+			t.Fatalf("result is %+v", c.res)
+		}
+		starts[c.h] = append(starts[c.h], c.start)
+	}
+	first := make(map[string]time.Time)
+	for h, ts := range starts {
+		sortTimes(ts)
+		for i := 1; i < len(ts); i++ {
+			// limiter may allow request slightly early by timer granularity.
+			if d := ts[i].Sub(ts[i-1]); d < interval-5*time.Millisecond {
+				t.Errorf("%s: requests are sent in %v", h, d)
+			}
+		}
+		first[h] = ts[0]
+	}
+	if d := first["a.example.com"].Sub(first["b.example.com"]); d > interval/2 || d < -interval/2 {
+		t.Errorf("first requests to different hosts are sent in %v", d)
+	}
+}
+
+func sortTimes(ts []time.Time) {
+	for i := 1; i < len(ts); i++ {
+		for j := i; j > 0 && ts[j].Before(ts[j-1]); j-- {
+			ts[j], ts[j-1] = ts[j-1], ts[j]
+		}
+	}
+}
+
+func TestRunWorkerTimeout(t *testing.T) {
+	block := &blockWorker{make(chan struct{}), make(chan struct{}), &Result{}}
+	close(block.release)
+	var requests int32
+	wrk := []worker{block}
+	for i := 0; i < 5; i++ {
+		wrk = append(wrk, &sleepWorker{&requests, nil, &Result{}})
+	}
+
+	start := time.Now()
+	report := runWorker(context.Background(), wrk, newOptions([]Option{WithMaxConcurrency(1), WithTimeout(20 * time.Millisecond)}))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("send takes %v", d)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("%d workers are started after deadline", n)
+	}
+	for i, res := range report.Results {
+		if res.Sent || res.Err != context.DeadlineExceeded {
+			t.Errorf("%d: result is %+v", i, res)
+		}
+		if i > 0 && res.Attempts != 0 {
+			t.Errorf("%d: attempts are %d", i, res.Attempts)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/koichirokamoto/gko/log"
+	"github.com/mjibson/goon"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	_ SubscriptionStore       = (*DatastoreSubscriptionStore)(nil)
+	_ InvalidRecipientHandler = (*DatastoreSubscriptionStore)(nil)
+)
+
+// subscriptionJSON is json of PushSubscription sent from browser.
+//
+// ContentEncoding is one of PushManager.supportedContentEncodings chosen by browser.
+type subscriptionJSON struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	ContentEncoding ContentEncoding `json:"contentEncoding"`
+	// OldEndpoint is endpoint replaced by this subscription, it is used by update.
+	OldEndpoint string `json:"oldEndpoint"`
+}
+
+func (s *subscriptionJSON) subscription() *FcmSubscription {
+	return &FcmSubscription{
+		Endpoint: s.Endpoint,
+		Key:      s.Keys.P256dh,
+		Auth:     s.Keys.Auth,
+		Encoding: s.ContentEncoding,
+	}
+}
+
+// ParseSubscription parses and validates PushSubscription json sent from browser.
+func ParseSubscription(r io.Reader) (*FcmSubscription, error) {
+	_, sub, err := parseSubscription(r)
+	return sub, err
+}
+
+// parseSubscription parses and validates PushSubscription json, and also return json to read oldEndpoint.
+func parseSubscription(r io.Reader) (*subscriptionJSON, *FcmSubscription, error) {
+	var s subscriptionJSON
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, nil, err
+	}
+	sub := s.subscription()
+	if err := sub.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &s, sub, nil
+}
+
+// Validate validates endpoint, key and auth of subscription.
+func (f *FcmSubscription) Validate() error {
+	u, err := url.Parse(f.Endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint must be absolute https url")
+	}
+
+	key, err := decodeBase64(f.Key)
+	if err != nil {
+		return err
+	}
+	if len(key) != 65 || key[0] != 4 {
+		return errors.New("key must be uncompressed P-256 public key")
+	}
+	auth, err := decodeBase64(f.Auth)
+	if err != nil {
+		return err
+	}
+	if len(auth) != 16 {
+		return errors.New("auth must be 16 bytes")
+	}
+
+	switch f.Encoding {
+	case "", AESGCM, AES128GCM:
+	default:
+		return errors.New("unknown content encoding " + string(f.Encoding))
+	}
+	return nil
+}
+
+// SubscriptionStore stores web push subscriptions.
+type SubscriptionStore interface {
+	// Save saves subscription of user.
+	Save(ctx context.Context, userID string, sub *FcmSubscription) error
+	// Update replaces subscription of old endpoint with sub.
+	Update(ctx context.Context, userID, oldEndpoint string, sub *FcmSubscription) error
+	// Delete deletes subscription of endpoint.
+	Delete(ctx context.Context, userID, endpoint string) error
+}
+
+// SubscriptionHandler is http handler of subscribe, update and unsubscribe requests from browser.
+//
+// Subscribe and Update accept PushSubscription json, Update also needs oldEndpoint.
+// Unsubscribe accepts json which has endpoint.
+type SubscriptionHandler struct {
+	Store SubscriptionStore
+	// UserID return id of user who sends request, empty user id is used if it is nil.
+	UserID func(*http.Request) (string, error)
+	// Context return context of request, appengine.NewContext is used if it is nil.
+	Context func(*http.Request) context.Context
+}
+
+func (h *SubscriptionHandler) context(r *http.Request) context.Context {
+	if h.Context == nil {
+		return appengine.NewContext(r)
+	}
+	return h.Context(r)
+}
+
+func (h *SubscriptionHandler) userID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if h.UserID == nil {
+		return "", true
+	}
+	uid, err := h.UserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return "", false
+	}
+	return uid, true
+}
+
+func (h *SubscriptionHandler) post(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (h *SubscriptionHandler) parse(w http.ResponseWriter, r *http.Request) (*subscriptionJSON, bool) {
+	if !h.post(w, r) {
+		return nil, false
+	}
+	var s subscriptionJSON
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &s, true
+}
+
+// Subscribe saves subscription and responds 201.
+func (h *SubscriptionHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	if !h.post(w, r) {
+		return
+	}
+	sub, err := ParseSubscription(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	uid, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := h.context(r)
+	if err := h.Store.Save(ctx, uid, sub); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Update replaces subscription of oldEndpoint and responds 200.
+func (h *SubscriptionHandler) Update(w http.ResponseWriter, r *http.Request) {
+	if !h.post(w, r) {
+		return
+	}
+	s, sub, err := parseSubscription(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.OldEndpoint == "" {
+		http.Error(w, "oldEndpoint is required", http.StatusBadRequest)
+		return
+	}
+	uid, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := h.context(r)
+	if err := h.Store.Update(ctx, uid, s.OldEndpoint, sub); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Unsubscribe deletes subscription and responds 204.
+func (h *SubscriptionHandler) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.parse(w, r)
+	if !ok {
+		return
+	}
+	if s.Endpoint == "" {
+		http.Error(w, "endpoint is required", http.StatusBadRequest)
+		return
+	}
+	uid, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := h.context(r)
+	if err := h.Store.Delete(ctx, uid, s.Endpoint); err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pushSubscription is datastore entity of web push subscription.
+//
+// ID is hash of endpoint, so the same endpoint is stored once.
+type pushSubscription struct {
+	_kind     string    `goon:"kind,PushSubscription"`
+	ID        string    `datastore:"-" goon:"id"`
+	UserID    string    `datastore:"UserID"`
+	Endpoint  string    `datastore:"Endpoint,noindex"`
+	Key       string    `datastore:"Key,noindex"`
+	Auth      string    `datastore:"Auth,noindex"`
+	Encoding  string    `datastore:"Encoding,noindex"`
+	CreatedAt time.Time `datastore:"CreatedAt,noindex"`
+	UpdatedAt time.Time `datastore:"UpdatedAt,noindex"`
+}
+
+func subscriptionID(endpoint string) string {
+	h := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(h[:])
+}
+
+func (p *pushSubscription) subscription() *FcmSubscription {
+	return &FcmSubscription{
+		Endpoint: p.Endpoint,
+		Key:      p.Key,
+		Auth:     p.Auth,
+		Encoding: ContentEncoding(p.Encoding),
+	}
+}
+
+// DatastoreSubscriptionStore stores subscriptions in datastore with goon.
+//
+// It also deletes subscriptions which push service answers are no longer valid.
+type DatastoreSubscriptionStore struct{}
+
+// Save saves subscription of user, existing subscription of the same endpoint is overwritten.
+//
+// Get and put run in transaction, so CreatedAt of concurrent saves of the same endpoint is kept.
+func (d *DatastoreSubscriptionStore) Save(ctx context.Context, userID string, sub *FcmSubscription) error {
+	g := goon.FromContext(ctx)
+	return g.RunInTransaction(func(tg *goon.Goon) error {
+		return saveSubscription(tg, userID, sub)
+	}, nil)
+}
+
+// Update saves sub and deletes subscription of old endpoint.
+//
+// Both run in one cross group transaction, so old endpoint is not left when delete fails.
+func (d *DatastoreSubscriptionStore) Update(ctx context.Context, userID, oldEndpoint string, sub *FcmSubscription) error {
+	g := goon.FromContext(ctx)
+	return g.RunInTransaction(func(tg *goon.Goon) error {
+		if err := saveSubscription(tg, userID, sub); err != nil {
+			return err
+		}
+		if oldEndpoint == sub.Endpoint {
+			return nil
+		}
+		return deleteSubscription(tg, userID, oldEndpoint)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// Delete deletes subscription of endpoint if it belongs to user.
+func (d *DatastoreSubscriptionStore) Delete(ctx context.Context, userID, endpoint string) error {
+	return deleteSubscription(goon.FromContext(ctx), userID, endpoint)
+}
+
+func saveSubscription(g *goon.Goon, userID string, sub *FcmSubscription) error {
+	now := time.Now()
+	e := &pushSubscription{ID: subscriptionID(sub.Endpoint)}
+	if err := g.Get(e); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	} else if err == datastore.ErrNoSuchEntity {
+		e.CreatedAt = now
+	}
+
+	e.UserID = userID
+	e.Endpoint = sub.Endpoint
+	e.Key = sub.Key
+	e.Auth = sub.Auth
+	e.Encoding = string(sub.Encoding)
+	e.UpdatedAt = now
+	_, err := g.Put(e)
+	return err
+}
+
+func deleteSubscription(g *goon.Goon, userID, endpoint string) error {
+	e := &pushSubscription{ID: subscriptionID(endpoint)}
+	if err := g.Get(e); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if e.UserID != userID {
+		return nil
+	}
+	return g.Delete(g.Key(e))
+}
+
+// List return subscriptions of user.
+func (d *DatastoreSubscriptionStore) List(ctx context.Context, userID string) ([]*FcmSubscription, error) {
+	g := goon.FromContext(ctx)
+	var es []*pushSubscription
+	q := datastore.NewQuery("PushSubscription").Filter("UserID =", userID)
+	if _, err := g.GetAll(q, &es); err != nil {
+		return nil, err
+	}
+	subs := make([]*FcmSubscription, len(es))
+	for i, e := range es {
+		subs[i] = e.subscription()
+	}
+	return subs, nil
+}
+
+// InvalidSubscription deletes subscription regardless of its user.
+func (d *DatastoreSubscriptionStore) InvalidSubscription(ctx context.Context, sub *FcmSubscription) error {
+	g := goon.FromContext(ctx)
+	e := &pushSubscription{ID: subscriptionID(sub.Endpoint)}
+	return g.Delete(g.Key(e))
+}
+
+// InvalidDeviceToken does nothing, the store has only web push subscriptions.
+func (d *DatastoreSubscriptionStore) InvalidDeviceToken(ctx context.Context, token string) error {
+	return nil
+}
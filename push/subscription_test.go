@@ -0,0 +1,95 @@
+package push
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	testP256dh = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	testAuth   = "BTBZMqHH6r4Tts7J_aSIgg"
+)
+
+type testSubscriptionStore struct {
+	subs map[string]*FcmSubscription
+}
+
+func (s *testSubscriptionStore) Save(ctx context.Context, userID string, sub *FcmSubscription) error {
+	s.subs[sub.Endpoint] = sub
+	return nil
+}
+
+func (s *testSubscriptionStore) Update(ctx context.Context, userID, oldEndpoint string, sub *FcmSubscription) error {
+	delete(s.subs, oldEndpoint)
+	s.subs[sub.Endpoint] = sub
+	return nil
+}
+
+func (s *testSubscriptionStore) Delete(ctx context.Context, userID, endpoint string) error {
+	delete(s.subs, endpoint)
+	return nil
+}
+
+func TestParseSubscription(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{`{"endpoint":"https://push.example.com/1","expirationTime":null,"keys":{"p256dh":"` + testP256dh + `","auth":"` + testAuth + `"}}`, true},
+		{`{"endpoint":"http://push.example.com/1","keys":{"p256dh":"` + testP256dh + `","auth":"` + testAuth + `"}}`, false},
+		{`{"endpoint":"https://push.example.com/1","keys":{"p256dh":"` + testAuth + `","auth":"` + testAuth + `"}}`, false},
+		{`{"endpoint":"https://push.example.com/1","keys":{"p256dh":"` + testP256dh + `","auth":"` + testP256dh + `"}}`, false},
+		{`{"endpoint":"https://push.example.com/1","keys":{"p256dh":"` + testP256dh + `","auth":"` + testAuth + `"},"contentEncoding":"br"}`, false},
+		{`{"endpoint":`, false},
+	}
+	for _, tt := range tests {
+		sub, err := ParseSubscription(strings.NewReader(tt.body))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error is %v", tt.body, err)
+			continue
+		}
+		if tt.ok && (sub.Endpoint != "https://push.example.com/1" || sub.Key != testP256dh || sub.Auth != testAuth) {
+			t.Errorf("subscription is %+v", sub)
+		}
+	}
+}
+
+func TestSubscriptionHandler(t *testing.T) {
+	store := &testSubscriptionStore{subs: make(map[string]*FcmSubscription)}
+	h := &SubscriptionHandler{
+		Store:   store,
+		Context: func(r *http.Request) context.Context { return context.Background() },
+	}
+	keys := `"keys":{"p256dh":"` + testP256dh + `","auth":"` + testAuth + `"}`
+
+	tests := []struct {
+		handler http.HandlerFunc
+		body    string
+		code    int
+		want    string
+	}{
+		{h.Subscribe, `{"endpoint":"https://push.example.com/1",` + keys + `}`, http.StatusCreated, "https://push.example.com/1"},
+		{h.Subscribe, `{"endpoint":"https://push.example.com/1"}`, http.StatusBadRequest, "https://push.example.com/1"},
+		{h.Update, `{"endpoint":"https://push.example.com/2",` + keys + `}`, http.StatusBadRequest, "https://push.example.com/1"},
+		{h.Update, `{"oldEndpoint":"https://push.example.com/1","endpoint":"https://push.example.com/2",` + keys + `}`, http.StatusOK, "https://push.example.com/2"},
+		{h.Unsubscribe, `{"endpoint":"https://push.example.com/2"}`, http.StatusNoContent, ""},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%d: status is %d, want %d", i, w.Code, tt.code)
+		}
+		var got string
+		for e := range store.subs {
+			got = e
+		}
+		if len(store.subs) > 1 || got != tt.want {
+			t.Errorf("%d: subscriptions are %v", i, store.subs)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package push
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/koichirokamoto/gko/cloud/gcp/gae"
+	"github.com/koichirokamoto/gko/log"
+	"github.com/mjibson/goon"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	// DefaultTaskChunkSize is number of subscriptions in one task used if chunk size is not set.
+	DefaultTaskChunkSize = 100
+
+	// maxAddMulti is max number of tasks added at once.
+	maxAddMulti = 100
+	// maxTaskBodySize is max size of encoded task body, task must be smaller than 100KB
+	// including url and headers.
+	maxTaskBodySize = 90 << 10
+
+	taskSubscriptionsParam = "subscriptions"
+	taskPayloadParam       = "payload"
+	taskJobParam           = "job"
+	taskNameHeader         = "X-AppEngine-TaskName"
+)
+
+// EnqueueFcmNotification enqueues web push notification to task queue instead of sending it.
+//
+// Subscriptions are split into tasks of at most chunk size, each task is sent by FcmTaskHandler served at path.
+// Task is also split before its body exceeds size limit of task.
+func EnqueueFcmNotification(ctx context.Context, q gae.Queue, p gae.Path, subs []*FcmSubscription, payload []byte, chunkSize int) ([]*taskqueue.Task, error) {
+	tasks, err := newFcmTasks(p, subs, payload, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return addTasks(ctx, q, tasks)
+}
+
+func newFcmTasks(p gae.Path, subs []*FcmSubscription, payload []byte, chunkSize int) ([]*taskqueue.Task, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultTaskChunkSize
+	}
+
+	// size of body without subscriptions, job id is always 32 hex characters.
+	base := len(fcmTaskParams(strings.Repeat("0", 32), []byte("[]"), payload).Encode())
+	var tasks []*taskqueue.Task
+	for i := 0; i < len(subs); {
+		size := base
+		end := i
+		for ; end < len(subs) && end-i < chunkSize; end++ {
+			b, err := json.Marshal(subs[end])
+			if err != nil {
+				return nil, err
+			}
+			// escaped json of slice is escaped elements joined with escaped comma.
+			n := len(url.QueryEscape(string(b)))
+			if end > i {
+				n += len(url.QueryEscape(","))
+			}
+			if size+n > maxTaskBodySize {
+				break
+			}
+			size += n
+		}
+		if end == i {
+			return nil, fmt.Errorf("task of subscription %s exceeds %d bytes", subs[i].Endpoint, maxTaskBodySize)
+		}
+
+		b, err := json.Marshal(subs[i:end])
+		if err != nil {
+			return nil, err
+		}
+		job := make([]byte, 16)
+		if _, err := rand.Read(job); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, p.POSTTask(fcmTaskParams(hex.EncodeToString(job), b, payload)))
+		i = end
+	}
+	return tasks, nil
+}
+
+func fcmTaskParams(job string, subs, payload []byte) url.Values {
+	params := url.Values{}
+	params.Set(taskJobParam, job)
+	params.Set(taskSubscriptionsParam, string(subs))
+	params.Set(taskPayloadParam, base64.StdEncoding.EncodeToString(payload))
+	return params
+}
+
+func addTasks(ctx context.Context, q gae.Queue, tasks []*taskqueue.Task) ([]*taskqueue.Task, error) {
+	var added []*taskqueue.Task
+	for i := 0; i < len(tasks); i += maxAddMulti {
+		end := i + maxAddMulti
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		t, err := q.AddMulti(ctx, tasks[i:end])
+		if err != nil {
+			return added, err
+		}
+		added = append(added, t...)
+	}
+	return added, nil
+}
+
+// pushTaskProgress is endpoints already done by task, it is keyed by job id of task.
+type pushTaskProgress struct {
+	_kind string   `goon:"kind,PushTaskProgress"`
+	ID    string   `datastore:"-" goon:"id"`
+	Sent  []string `datastore:",noindex"`
+	// Failed is endpoints failed with error which is not fixed by retry.
+	Failed []string `datastore:",noindex"`
+}
+
+// rest return subscriptions which are neither sent nor failed permanently.
+func (p *pushTaskProgress) rest(subs []*FcmSubscription) []*FcmSubscription {
+	done := make(map[string]bool, len(p.Sent)+len(p.Failed))
+	for _, e := range p.Sent {
+		done[e] = true
+	}
+	for _, e := range p.Failed {
+		done[e] = true
+	}
+	var rest []*FcmSubscription
+	for _, sub := range subs {
+		if !done[sub.Endpoint] {
+			rest = append(rest, sub)
+		}
+	}
+	return rest
+}
+
+// record records terminal results of report and return number of subscriptions to be retried.
+func (p *pushTaskProgress) record(report *Report) int {
+	var retry int
+	for _, res := range report.Results {
+		switch {
+		case res.Sent:
+			p.Sent = append(p.Sent, res.Subscription.Endpoint)
+		case res.Err != nil && !res.Invalid && isRetryable(res.Err):
+			retry++
+		default:
+			p.Failed = append(p.Failed, res.Subscription.Endpoint)
+		}
+	}
+	return retry
+}
+
+// FcmTaskHandler is http handler which sends web push enqueued by EnqueueFcmNotification.
+//
+// Sent and permanently failed endpoints are recorded per task, so retried task sends only to retryable rest.
+// It responds 500 if some subscriptions fail with retryable error so that task queue retries the task.
+// If progress can not be saved, it also responds 500 and retried task sends again to subscriptions done by the request.
+// Request without X-AppEngine-TaskName header is rejected, app engine removes it from requests not from task queue.
+type FcmTaskHandler struct {
+	// ServerKey is legacy server key, it is not used if vapid option is set.
+	ServerKey string
+	Options   []Option
+}
+
+// ServeHTTP sends web push in task.
+func (h *FcmTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskName := r.Header.Get(taskNameHeader)
+	if taskName == "" {
+		http.Error(w, "request is not from task queue", http.StatusForbidden)
+		return
+	}
+	ctx := appengine.NewContext(r)
+
+	var subs []*FcmSubscription
+	if err := json.Unmarshal([]byte(r.FormValue(taskSubscriptionsParam)), &subs); err != nil {
+		// task can not succeed by retry.
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(r.FormValue(taskPayloadParam))
+	if err != nil {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		return
+	}
+
+	g := goon.FromContext(ctx)
+	progress := &pushTaskProgress{ID: r.FormValue(taskJobParam)}
+	if progress.ID == "" {
+		// task enqueued without job id, its name is unique in queue.
+		progress.ID = taskName
+	}
+	if err := g.Get(progress); err != nil && err != datastore.ErrNoSuchEntity {
+		log.DefaultLogger.Log(ctx, log.Error, "%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	report := SendFcmNotification(ctx, urlfetch.Client(ctx), h.ServerKey, progress.rest(subs), payload, h.Options...)
+	retry := progress.record(report)
+	log.DefaultLogger.Log(ctx, log.Info, "task %s: sent %d, failed %d, retry %d of %d subscriptions",
+		taskName, len(progress.Sent), len(progress.Failed), retry, len(subs))
+
+	if retry == 0 {
+		if err := g.Delete(g.Key(progress)); err != nil {
+			log.DefaultLogger.Log(ctx, log.Warning, "%v", err)
+		}
+		return
+	}
+
+	if _, err := g.Put(progress); err != nil {
+		// retried task can not skip subscriptions done by this request.
+		log.DefaultLogger.Log(ctx, log.Error, "progress of task %s is not saved, %d subscriptions will be sent again: %v",
+			taskName, len(progress.Sent)+len(progress.Failed), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "some subscriptions failed", http.StatusInternalServerError)
+}
@@ -0,0 +1,141 @@
+package push
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewFcmTasks(t *testing.T) {
+	subs := make([]*FcmSubscription, 5)
+	for i := range subs {
+		subs[i] = &FcmSubscription{Endpoint: "https://example.com/" + string(rune('a'+i))}
+	}
+	tasks, err := newFcmTasks("/push/task", subs, []byte("hello"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 3 {
+		t.Fatalf("tasks are %d", len(tasks))
+	}
+
+	jobs := make(map[string]bool)
+	for _, task := range tasks {
+		params, err := url.ParseQuery(string(task.Payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.Get(taskPayloadParam) != base64.StdEncoding.EncodeToString([]byte("hello")) {
+			t.Errorf("params are %v", params)
+		}
+		jobs[params.Get(taskJobParam)] = true
+	}
+	if len(jobs) != len(tasks) || jobs[""] {
+		t.Errorf("job ids are %v", jobs)
+	}
+}
+
+func TestNewFcmTasksSize(t *testing.T) {
+	// subscription of fcm has long endpoint, p256dh key and auth.
+	subs := make([]*FcmSubscription, 1000)
+	for i := range subs {
+		subs[i] = &FcmSubscription{
+			Endpoint: fmt.Sprintf("https://fcm.googleapis.com/fcm/send/%04d:APA91bHun4MxP5egoKMwt2KZFBaFUH-1RYqx4MrxBdt_Ot6ae3rwbO7J1-yx8h4rgf0Dr7N0qjYYfIjYDi6aF1X2YpHhXQ3nPzwh1nMsn5wKg5BTWpHkXyM0c6WZqrtY3LuDbKyFqZ0z8qeH", i),
+			Key:      "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM",
+			Auth:     "tBHItJI5svbpez7KI4CCXg",
+			Encoding: AES128GCM,
+		}
+	}
+	payload := []byte(strings.Repeat("x", 4096))
+
+	for _, chunkSize := range []int{0, 500} {
+		tasks, err := newFcmTasks("/push/task", subs, payload, chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, task := range tasks {
+			if len(task.Payload) > maxTaskBodySize {
+				t.Errorf("%d: task is %d bytes", chunkSize, len(task.Payload))
+			}
+			params, err := url.ParseQuery(string(task.Payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var chunk []*FcmSubscription
+			if err := json.Unmarshal([]byte(params.Get(taskSubscriptionsParam)), &chunk); err != nil {
+				t.Fatal(err)
+			}
+			if chunkSize == 0 && len(chunk) > DefaultTaskChunkSize {
+				t.Errorf("task has %d subscriptions", len(chunk))
+			}
+			if len(chunk) > 0 && chunk[0].Endpoint != subs[n].Endpoint {
+				t.Errorf("%d: task starts with %s, want %s", chunkSize, chunk[0].Endpoint, subs[n].Endpoint)
+			}
+			n += len(chunk)
+		}
+		if n != len(subs) {
+			t.Errorf("%d: tasks have %d subscriptions", chunkSize, n)
+		}
+	}
+
+	huge := []*FcmSubscription{{Endpoint: "https://example.com/" + strings.Repeat("a", maxTaskBodySize)}}
+	if _, err := newFcmTasks("/push/task", huge, payload, 0); err == nil {
+		t.Error("task exceeding size limit is created")
+	}
+}
+
+func TestPushTaskProgress(t *testing.T) {
+	subs := make([]*FcmSubscription, 5)
+	for i := range subs {
+		subs[i] = &FcmSubscription{Endpoint: "https://example.com/" + string(rune('a'+i))}
+	}
+	p := &pushTaskProgress{}
+	retry := p.record(&Report{Results: []*Result{
+		{Subscription: subs[0], Sent: true},
+		{Subscription: subs[1], Err: &sendError{msg: "400"}},
+		{Subscription: subs[2], Err: &sendError{msg: "410"}, Invalid: true},
+		{Subscription: subs[3], Err: &sendError{msg: "503", retryable: true}},
+		{Subscription: subs[4], Err: errors.New("network error")},
+	}})
+	if retry != 2 || len(p.Sent) != 1 || len(p.Failed) != 2 {
+		t.Errorf("retry is %d, progress is %+v", retry, p)
+	}
+	rest := p.rest(subs)
+	if len(rest) != 2 || rest[0] != subs[3] || rest[1] != subs[4] {
+		t.Errorf("rest is %v", rest)
+	}
+}
+
+func TestFcmTaskHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		taskName string
+		body     string
+		want     int
+	}{
+		// app engine removes task name header from external requests.
+		{"not from task queue", "", "subscriptions=[]", http.StatusForbidden},
+		// broken task is not retried.
+		{"broken subscriptions", "task1", "subscriptions=broken", http.StatusOK},
+		{"broken payload", "task1", "subscriptions=[]&payload=%25", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/push/task", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.taskName != "" {
+			r.Header.Set(taskNameHeader, tt.taskName)
+		}
+		w := httptest.NewRecorder()
+		(&FcmTaskHandler{}).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status is %d", tt.name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package push
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// vapidExpiration is lifetime of vapid jwt, it must not be longer than 24 hours.
+const vapidExpiration = 12 * time.Hour
+
+// VAPIDKeys is application server key pair of VAPID (RFC 8292).
+type VAPIDKeys struct {
+	private *ecdsa.PrivateKey
+}
+
+// GenerateVAPIDKeys generates new ECDSA P-256 key pair.
+func GenerateVAPIDKeys() (*VAPIDKeys, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKeys{private}, nil
+}
+
+// ParseVAPIDKeys parses url safe base64 encoded private key returned by VAPIDKeys.PrivateKey.
+func ParseVAPIDKeys(privateKey string) (*VAPIDKeys, error) {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != 32 {
+		return nil, errors.New("vapid private key must be 32 bytes")
+	}
+
+	curve := elliptic.P256()
+	private := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	if private.D.Sign() == 0 || private.D.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("vapid private key is out of range")
+	}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d)
+	if !curve.IsOnCurve(private.PublicKey.X, private.PublicKey.Y) {
+		return nil, errors.New("vapid public key is not on curve")
+	}
+	return &VAPIDKeys{private}, nil
+}
+
+// PublicKey return url safe base64 encoded uncompressed public key.
+//
+// It is used as applicationServerKey of PushManager.subscribe in browser.
+func (k *VAPIDKeys) PublicKey() string {
+	b := elliptic.Marshal(k.private.Curve, k.private.X, k.private.Y)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// PrivateKey return url safe base64 encoded private key.
+func (k *VAPIDKeys) PrivateKey() string {
+	d := make([]byte, 32)
+	b := k.private.D.Bytes()
+	copy(d[len(d)-len(b):], b)
+	return base64.RawURLEncoding.EncodeToString(d)
+}
+
+// vapid signs jwt for push service and caches it per audience.
+type vapid struct {
+	keys    *VAPIDKeys
+	subject string
+
+	mu     sync.Mutex
+	tokens map[string]*vapidToken
+}
+
+type vapidToken struct {
+	token string
+	exp   time.Time
+}
+
+func newVAPID(keys *VAPIDKeys, subject string) *vapid {
+	return &vapid{keys: keys, subject: subject, tokens: make(map[string]*vapidToken)}
+}
+
+// token return jwt whose audience is origin of endpoint.
+func (v *vapid) token(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	aud := u.Scheme + "://" + u.Host
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if t, ok := v.tokens[aud]; ok && now.Add(time.Minute).Before(t.exp) {
+		return t.token, nil
+	}
+
+	exp := now.Add(vapidExpiration)
+	claims := jwt.MapClaims{
+		"aud": aud,
+		"exp": exp.Unix(),
+		"sub": v.subject,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(v.keys.private)
+	if err != nil {
+		return "", err
+	}
+	v.tokens[aud] = &vapidToken{token, exp}
+	return token, nil
+}
@@ -0,0 +1,106 @@
+package push
+
+import (
+	"crypto/elliptic"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestParseVAPIDKeys(t *testing.T) {
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseVAPIDKeys(keys.PrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.PrivateKey() != keys.PrivateKey() || parsed.PublicKey() != keys.PublicKey() {
+		t.Errorf("parsed keys are %s %s, want %s %s", parsed.PrivateKey(), parsed.PublicKey(), keys.PrivateKey(), keys.PublicKey())
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(keys.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pub) != 65 || pub[0] != 4 {
+		t.Errorf("public key is %x", pub)
+	}
+
+	n := elliptic.P256().Params().N
+	encode := func(b []byte) string {
+		d := make([]byte, 32)
+		copy(d[32-len(b):], b)
+		return base64.RawURLEncoding.EncodeToString(d)
+	}
+	for _, invalid := range []string{
+		"",
+		"!!!",
+		encode(nil),
+		encode(n.Bytes()),
+		encode([]byte(strings.Repeat("\xff", 32))),
+		base64.RawURLEncoding.EncodeToString(make([]byte, 31)),
+	} {
+		if _, err := ParseVAPIDKeys(invalid); err == nil {
+			t.Errorf("%q is parsed", invalid)
+		}
+	}
+}
+
+func TestVAPIDToken(t *testing.T) {
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newVAPID(keys, "mailto:admin@example.com")
+
+	token, err := v.token("https://push.example.com/send/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jwt.Parse(token, func(tok *jwt.Token) (interface{}, error) {
+		if tok.Method != jwt.SigningMethodES256 {
+			t.Errorf("signing method is %v", tok.Header["alg"])
+		}
+		return &keys.private.PublicKey, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+	if claims["aud"] != "https://push.example.com" || claims["sub"] != "mailto:admin@example.com" {
+		t.Errorf("claims are %v", claims)
+	}
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	if d := time.Until(exp); d <= 11*time.Hour || vapidExpiration < d {
+		t.Errorf("token expires in %v", d)
+	}
+
+	cached, err := v.token("https://push.example.com/send/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != token {
+		t.Error("token of the same audience is not cached")
+	}
+	other, err := v.token("https://other.example.com/send/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == token {
+		t.Error("token is shared by different audiences")
+	}
+
+	// expired token is signed again.
+	v.tokens["https://push.example.com"].exp = time.Now()
+	renewed, err := v.token("https://push.example.com/send/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == token {
+		t.Error("expired token is reused")
+	}
+}
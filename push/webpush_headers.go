@@ -0,0 +1,83 @@
+package push
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxTopicLength = 32
+
+// Urgency is urgency of web push, push service may deliver low urgency message later to save battery.
+type Urgency string
+
+// Urgencies of web push (RFC 8030 section 5.3).
+const (
+	UrgencyVeryLow Urgency = "very-low"
+	UrgencyLow     Urgency = "low"
+	UrgencyNormal  Urgency = "normal"
+	UrgencyHigh    Urgency = "high"
+)
+
+// WithTTL set how long push service keeps message for offline device.
+//
+// Zero means message is dropped unless device is online.
+// TTL header is not sent if it is not set, and push service keeps message by its default.
+func WithTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.ttl = &d
+	}
+}
+
+// WithUrgency set urgency of web push.
+func WithUrgency(u Urgency) Option {
+	return func(o *options) {
+		o.urgency = u
+	}
+}
+
+// WithTopic set topic of web push.
+//
+// Message pending in push service is replaced by new message which has the same topic.
+// Topic must be at most 32 characters of url safe base64 alphabet.
+func WithTopic(topic string) Option {
+	return func(o *options) {
+		o.topic = topic
+	}
+}
+
+// validateWebPushHeaders validates TTL, urgency and topic.
+func (o *options) validateWebPushHeaders() error {
+	if o.ttl != nil && *o.ttl < 0 {
+		return fmt.Errorf("ttl must not be negative, %s", *o.ttl)
+	}
+
+	switch o.urgency {
+	case "", UrgencyVeryLow, UrgencyLow, UrgencyNormal, UrgencyHigh:
+	default:
+		return fmt.Errorf("unknown urgency %s", o.urgency)
+	}
+
+	if len(o.topic) > maxTopicLength {
+		return fmt.Errorf("topic must not be longer than %d characters", maxTopicLength)
+	}
+	for _, c := range o.topic {
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("topic must consist of url safe base64 alphabet, %s", o.topic)
+		}
+	}
+	return nil
+}
+
+func (o *options) setWebPushHeaders(h http.Header) {
+	if o.ttl != nil {
+		h.Set("TTL", strconv.FormatInt(int64(*o.ttl/time.Second), 10))
+	}
+	if o.urgency != "" {
+		h.Set("Urgency", string(o.urgency))
+	}
+	if o.topic != "" {
+		h.Set("Topic", o.topic)
+	}
+}
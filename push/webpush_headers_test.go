@@ -0,0 +1,93 @@
+package push
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebPushHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "not set",
+			want: map[string]string{"TTL": "", "Urgency": "", "Topic": ""},
+		},
+		{
+			name: "all set",
+			opts: []Option{WithTTL(time.Hour), WithUrgency(UrgencyHigh), WithTopic("news-1_a")},
+			want: map[string]string{"TTL": "3600", "Urgency": "high", "Topic": "news-1_a"},
+		},
+		{
+			name: "zero ttl",
+			opts: []Option{WithTTL(0)},
+			want: map[string]string{"TTL": "0"},
+		},
+		{
+			name: "ttl is truncated to seconds",
+			opts: []Option{WithTTL(1500 * time.Millisecond)},
+			want: map[string]string{"TTL": "1"},
+		},
+		{
+			name:    "negative ttl",
+			opts:    []Option{WithTTL(-time.Second)},
+			wantErr: true,
+		},
+		{
+			name: "very low urgency",
+			opts: []Option{WithUrgency(UrgencyVeryLow)},
+			want: map[string]string{"Urgency": "very-low"},
+		},
+		{
+			name:    "unknown urgency",
+			opts:    []Option{WithUrgency("urgent")},
+			wantErr: true,
+		},
+		{
+			name: "topic of 32 characters",
+			opts: []Option{WithTopic(strings.Repeat("a", 32))},
+			want: map[string]string{"Topic": strings.Repeat("a", 32)},
+		},
+		{
+			name:    "topic of 33 characters",
+			opts:    []Option{WithTopic(strings.Repeat("a", 33))},
+			wantErr: true,
+		},
+		{
+			name:    "topic with space",
+			opts:    []Option{WithTopic("not valid")},
+			wantErr: true,
+		},
+		{
+			name:    "topic with padding",
+			opts:    []Option{WithTopic("topic==")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		o := newOptions(tt.opts)
+		err := o.validateWebPushHeaders()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: error is nil", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		h := make(http.Header)
+		o.setWebPushHeaders(h)
+		for k, v := range tt.want {
+			if got := h.Get(k); got != v {
+				t.Errorf("%s: %s is %q, want %q", tt.name, k, got, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/koichirokamoto/gko/push"
+	"github.com/sideshow/apns2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// injectedError is error response returned instead of accepting notification.
+type injectedError struct {
+	status int
+	reason string
+	// n is number of responses, negative means unlimited.
+	n int
+	// retryAfter is value of Retry-After header, it is not set if it is empty.
+	retryAfter string
+}
+
+// take return true if error should be returned for this request.
+func (e *injectedError) take() bool {
+	if e == nil || e.n == 0 {
+		return false
+	}
+	if e.n > 0 {
+		e.n--
+	}
+	return true
+}
+
+// ReceivedWebPush is web push received by FakeWebPushServer.
+type ReceivedWebPush struct {
+	Endpoint string
+	Header   http.Header
+	// Payload is decrypted payload.
+	Payload []byte
+	// Err is error occurred while decrypting payload.
+	Err error
+}
+
+// FakeWebPushServer is fake web push service.
+//
+// Subscriptions returned by Subscription share one key pair, so the server can decrypt payload.
+type FakeWebPushServer struct {
+	*httptest.Server
+
+	private []byte
+	public  []byte
+	auth    []byte
+
+	mu       sync.Mutex
+	seq      int
+	received []*ReceivedWebPush
+	errors   map[string]*injectedError
+}
+
+// NewFakeWebPushServer starts new fake web push service.
+func NewFakeWebPushServer() (*FakeWebPushServer, error) {
+	curve := elliptic.P256()
+	private, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	auth := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, auth); err != nil {
+		return nil, err
+	}
+
+	s := &FakeWebPushServer{
+		private: private,
+		public:  elliptic.Marshal(curve, x, y),
+		auth:    auth,
+		errors:  make(map[string]*injectedError),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s, nil
+}
+
+// Subscription return new subscription of which endpoint is this server.
+func (s *FakeWebPushServer) Subscription(encoding push.ContentEncoding) *push.FcmSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return &push.FcmSubscription{
+		Endpoint: s.URL + "/push/" + strconv.Itoa(s.seq),
+		Key:      base64.RawURLEncoding.EncodeToString(s.public),
+		Auth:     base64.RawURLEncoding.EncodeToString(s.auth),
+		Encoding: encoding,
+	}
+}
+
+// InjectError makes server answer status and body to next n requests to subscription.
+//
+// Negative n means all requests.
+func (s *FakeWebPushServer) InjectError(sub *push.FcmSubscription, status int, body string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[sub.Endpoint] = &injectedError{status: status, reason: body, n: n}
+}
+
+// Received return web push accepted by server.
+func (s *FakeWebPushServer) Received() []*ReceivedWebPush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ReceivedWebPush(nil), s.received...)
+}
+
+func (s *FakeWebPushServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint := s.URL + r.URL.Path
+	s.mu.Lock()
+	e := s.errors[endpoint]
+	inject := e.take()
+	s.mu.Unlock()
+	if inject {
+		http.Error(w, e.reason, e.status)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec := &ReceivedWebPush{Endpoint: endpoint, Header: r.Header}
+	rec.Payload, rec.Err = s.decrypt(r.Header, body)
+
+	s.mu.Lock()
+	s.received = append(s.received, rec)
+	s.mu.Unlock()
+
+	if rec.Err != nil {
+		http.Error(w, rec.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *FakeWebPushServer) decrypt(h http.Header, body []byte) ([]byte, error) {
+	switch push.ContentEncoding(h.Get("Content-Encoding")) {
+	case push.AES128GCM:
+		return s.decryptAES128GCM(body)
+	case push.AESGCM:
+		return s.decryptAESGCM(h, body)
+	}
+	return nil, fmt.Errorf("unknown content encoding %s", h.Get("Content-Encoding"))
+}
+
+// decryptAES128GCM decrypts body of RFC 8291.
+func (s *FakeWebPushServer) decryptAES128GCM(body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("body is shorter than header")
+	}
+	salt := body[:16]
+	rs := int(binary.BigEndian.Uint32(body[16:20]))
+	idlen := int(body[20])
+	if len(body) < 21+idlen {
+		return nil, errors.New("body is shorter than key id")
+	}
+	asPublic := body[21 : 21+idlen]
+	body = body[21+idlen:]
+
+	secret, err := s.ecdh(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	info := append(append([]byte("WebPush: info\x00"), s.public...), asPublic...)
+	ikm := derive(s.auth, secret, info, 32)
+	gcm, nonce, err := contentCipher(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), []byte("Content-Encoding: nonce\x00"))
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	for seq := uint64(0); len(body) > 0; seq++ {
+		n := rs
+		if n > len(body) {
+			n = len(body)
+		}
+		record, err := gcm.Open(nil, recordNonce(nonce, seq), body[:n], nil)
+		if err != nil {
+			return nil, err
+		}
+		body = body[n:]
+
+		// remove padding and delimiter.
+		i := len(record) - 1
+		for i >= 0 && record[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return nil, errors.New("record has no delimiter")
+		}
+		if last := record[i] == 2; last != (len(body) == 0) {
+			return nil, errors.New("delimiter of record is not correct")
+		}
+		plaintext = append(plaintext, record[:i]...)
+	}
+	return plaintext, nil
+}
+
+// decryptAESGCM decrypts body of draft-ietf-webpush-encryption-04.
+func (s *FakeWebPushServer) decryptAESGCM(h http.Header, body []byte) ([]byte, error) {
+	encryption := parseParams(h.Get("Encryption"))
+	cryptoKey := parseParams(h.Get("Crypto-Key"))
+	salt, err := decodeBase64(encryption["salt"])
+	if err != nil {
+		return nil, err
+	}
+	asPublic, err := decodeBase64(cryptoKey["dh"])
+	if err != nil {
+		return nil, err
+	}
+	rs := push.DefaultRecordSize
+	if v, ok := encryption["rs"]; ok {
+		if rs, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+
+	secret, err := s.ecdh(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	ikm := derive(s.auth, secret, []byte("Content-Encoding: auth\x00"), 32)
+	context := []byte("P-256\x00\x00\x41")
+	context = append(context, s.public...)
+	context = append(context, 0, 0x41)
+	context = append(context, asPublic...)
+	gcm, nonce, err := contentCipher(ikm, salt,
+		append([]byte("Content-Encoding: aesgcm\x00"), context...), append([]byte("Content-Encoding: nonce\x00"), context...))
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	for seq := uint64(0); len(body) > 0; seq++ {
+		n := rs + 16
+		if n > len(body) {
+			n = len(body)
+		}
+		record, err := gcm.Open(nil, recordNonce(nonce, seq), body[:n], nil)
+		if err != nil {
+			return nil, err
+		}
+		body = body[n:]
+		if len(record) < 2 {
+			return nil, errors.New("record is too short")
+		}
+		pad := int(binary.BigEndian.Uint16(record))
+		if len(record) < 2+pad {
+			return nil, errors.New("padding is longer than record")
+		}
+		plaintext = append(plaintext, record[2+pad:]...)
+	}
+	return plaintext, nil
+}
+
+func (s *FakeWebPushServer) ecdh(public []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, public)
+	if x == nil {
+		return nil, errors.New("public key is not valid")
+	}
+	sx, _ := curve.ScalarMult(x, y, s.private)
+	secret := make([]byte, 32)
+	b := sx.Bytes()
+	copy(secret[32-len(b):], b)
+	return secret, nil
+}
+
+func derive(salt, secret, info []byte, n int) []byte {
+	b := make([]byte, n)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, info), b)
+	return b
+}
+
+func contentCipher(ikm, salt, keyInfo, nonceInfo []byte) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(derive(salt, ikm, keyInfo, 16))
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, derive(salt, ikm, nonceInfo, 12), nil
+}
+
+func recordNonce(nonce []byte, seq uint64) []byte {
+	n := append([]byte(nil), nonce...)
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], seq)
+	for i := range s {
+		n[len(n)-8+i] ^= s[i]
+	}
+	return n
+}
+
+// parseParams parses header value like "dh=xxx;p256ecdsa=yyy".
+func parseParams(v string) map[string]string {
+	m := make(map[string]string)
+	for _, p := range strings.FieldsFunc(v, func(r rune) bool { return r == ';' || r == ',' }) {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			m[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return m
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// ReceivedApns is notification received by FakeApnsServer.
+type ReceivedApns struct {
+	DeviceToken string
+	Header      http.Header
+	Payload     []byte
+}
+
+// FakeApnsServer is fake apns provider api served over HTTP/2.
+type FakeApnsServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	seq      int
+	received []*ReceivedApns
+	errors   map[string]*injectedError
+	expired  map[string]bool
+}
+
+// NewFakeApnsServer starts new fake apns server with TLS and HTTP/2.
+func NewFakeApnsServer() *FakeApnsServer {
+	s := &FakeApnsServer{errors: make(map[string]*injectedError), expired: make(map[string]bool)}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.Server.EnableHTTP2 = true
+	s.Server.StartTLS()
+	return s
+}
+
+// Apns2Client return apns2 client which sends to this server.
+//
+// Token and certificate of client are not verified.
+func (s *FakeApnsServer) Apns2Client() *apns2.Client {
+	return &apns2.Client{
+		Host:       s.URL,
+		HTTPClient: s.Client(),
+	}
+}
+
+// InjectError makes server answer status and reason to next n notifications to device token.
+//
+// Negative n means all notifications.
+func (s *FakeApnsServer) InjectError(deviceToken string, status int, reason string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[deviceToken] = &injectedError{status: status, reason: reason, n: n}
+}
+
+// InjectRetryAfter is InjectError whose responses have Retry-After header of seconds.
+func (s *FakeApnsServer) InjectRetryAfter(deviceToken string, status int, reason string, seconds, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[deviceToken] = &injectedError{status: status, reason: reason, n: n, retryAfter: strconv.Itoa(seconds)}
+}
+
+// ExpireProviderToken makes server answer ExpiredProviderToken to notifications sent with bearer.
+func (s *FakeApnsServer) ExpireProviderToken(bearer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired[bearer] = true
+}
+
+// Received return notifications accepted by server.
+func (s *FakeApnsServer) Received() []*ReceivedApns {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ReceivedApns(nil), s.received...)
+}
+
+func (s *FakeApnsServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+	if r.Method != http.MethodPost || token == r.URL.Path || r.ProtoMajor != 2 {
+		writeApnsError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+
+	s.mu.Lock()
+	e := s.errors[token]
+	inject := e.take()
+	expired := s.expired[strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")]
+	s.seq++
+	id := fmt.Sprintf("00000000-0000-0000-0000-%012d", s.seq)
+	s.mu.Unlock()
+	w.Header().Set("apns-id", id)
+	if expired {
+		writeApnsError(w, http.StatusForbidden, apns2.ReasonExpiredProviderToken)
+		return
+	}
+	if inject {
+		if e.retryAfter != "" {
+			w.Header().Set("Retry-After", e.retryAfter)
+		}
+		writeApnsError(w, e.status, e.reason)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || !json.Valid(body) {
+		writeApnsError(w, http.StatusBadRequest, "BadPayload")
+		return
+	}
+	if len(body) > push.MaxApnsVoIPPayloadSize || len(body) > push.MaxApnsPayloadSize && r.Header.Get("apns-push-type") != string(push.ApnsPushTypeVoIP) {
+		writeApnsError(w, http.StatusRequestEntityTooLarge, apns2.ReasonPayloadTooLarge)
+		return
+	}
+
+	s.mu.Lock()
+	s.received = append(s.received, &ReceivedApns{token, r.Header, body})
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeApnsError(w http.ResponseWriter, status int, reason string) {
+	res := map[string]interface{}{"reason": reason}
+	if status == http.StatusGone {
+		res["timestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
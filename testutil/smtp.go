@@ -0,0 +1,300 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReceivedMail is mail received by FakeSMTPServer.
+type ReceivedMail struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// FakeSMTPServer is fake smtp server listening on localhost.
+//
+// It supports STARTTLS or implicit TLS, and AUTH PLAIN and LOGIN.
+type FakeSMTPServer struct {
+	// Addr is host:port of server.
+	Addr string
+
+	ln          net.Listener
+	tlsConfig   *tls.Config
+	certPool    *x509.CertPool
+	implicitTLS bool
+	username    string
+	password    string
+
+	mu          sync.Mutex
+	received    []*ReceivedMail
+	connections int
+	wg          sync.WaitGroup
+}
+
+// NewFakeSMTPServer starts new fake smtp server with self-signed certificate.
+//
+// Server requires authentication by username and password if username is not empty.
+func NewFakeSMTPServer(implicitTLS bool, username, password string) (*FakeSMTPServer, error) {
+	cert, pool, err := selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeSMTPServer{
+		tlsConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		certPool:    pool,
+		implicitTLS: implicitTLS,
+		username:    username,
+		password:    password,
+	}
+	if implicitTLS {
+		s.ln, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Addr = s.ln.Addr().String()
+	go s.serve()
+	return s, nil
+}
+
+// ClientTLSConfig return tls config which trusts certificate of server.
+func (s *FakeSMTPServer) ClientTLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: s.certPool}
+}
+
+// Received return mails accepted by server.
+func (s *FakeSMTPServer) Received() []*ReceivedMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ReceivedMail(nil), s.received...)
+}
+
+// Connections return number of accepted connections.
+func (s *FakeSMTPServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// Close stops server and waits for connections to be closed.
+func (s *FakeSMTPServer) Close() error {
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *FakeSMTPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// smtpSession is state of one connection.
+type smtpSession struct {
+	conn   net.Conn
+	tp     *textproto.Conn
+	tls    bool
+	authed bool
+	mail   *ReceivedMail
+}
+
+func (s *FakeSMTPServer) handle(conn net.Conn) {
+	ss := &smtpSession{conn: conn, tp: textproto.NewConn(conn), tls: s.implicitTLS}
+	defer func() {
+		ss.tp.Close()
+	}()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	ss.tp.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			lines := []string{"localhost"}
+			if !ss.tls {
+				lines = append(lines, "STARTTLS")
+			}
+			lines = append(lines, "AUTH PLAIN LOGIN", "8BITMIME")
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				ss.tp.PrintfLine("250%s%s", sep, l)
+			}
+		case "STARTTLS":
+			if ss.tls {
+				ss.tp.PrintfLine("503 already tls")
+				continue
+			}
+			ss.tp.PrintfLine("220 ready to start tls")
+			tc := tls.Server(ss.conn, s.tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			ss.conn, ss.tp, ss.tls = tc, textproto.NewConn(tc), true
+		case "AUTH":
+			ss.authed = s.auth(ss, arg)
+			if ss.authed {
+				ss.tp.PrintfLine("235 authenticated")
+			} else {
+				ss.tp.PrintfLine("535 authentication failed")
+			}
+		case "MAIL":
+			if s.username != "" && !ss.authed {
+				ss.tp.PrintfLine("530 authentication required")
+				continue
+			}
+			ss.mail = &ReceivedMail{From: parsePath(arg)}
+			ss.tp.PrintfLine("250 ok")
+		case "RCPT":
+			if ss.mail == nil {
+				ss.tp.PrintfLine("503 need MAIL")
+				continue
+			}
+			ss.mail.To = append(ss.mail.To, parsePath(arg))
+			ss.tp.PrintfLine("250 ok")
+		case "DATA":
+			if ss.mail == nil || len(ss.mail.To) == 0 {
+				ss.tp.PrintfLine("503 need RCPT")
+				continue
+			}
+			ss.tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := ss.tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			ss.mail.Data = data
+			s.mu.Lock()
+			s.received = append(s.received, ss.mail)
+			s.mu.Unlock()
+			ss.mail = nil
+			ss.tp.PrintfLine("250 ok")
+		case "RSET":
+			ss.mail = nil
+			ss.tp.PrintfLine("250 ok")
+		case "NOOP":
+			ss.tp.PrintfLine("250 ok")
+		case "QUIT":
+			ss.tp.PrintfLine("221 bye")
+			return
+		default:
+			ss.tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func (s *FakeSMTPServer) auth(ss *smtpSession, arg string) bool {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return false
+	}
+	readResponse := func(challenge string) (string, bool) {
+		ss.tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return "", false
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		return string(b), err == nil
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		var resp string
+		if len(fields) > 1 {
+			b, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return false
+			}
+			resp = string(b)
+		} else {
+			var ok bool
+			if resp, ok = readResponse(""); !ok {
+				return false
+			}
+		}
+		parts := strings.Split(resp, "\x00")
+		return len(parts) == 3 && parts[1] == s.username && parts[2] == s.password
+	case "LOGIN":
+		user, ok := readResponse("Username:")
+		if !ok {
+			return false
+		}
+		pass, ok := readResponse("Password:")
+		return ok && user == s.username && pass == s.password
+	}
+	return false
+}
+
+// parsePath return address of "FROM:<addr> params".
+func parsePath(arg string) string {
+	start, end := strings.IndexByte(arg, '<'), strings.IndexByte(arg, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
+
+func selfSignedCertificate() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool, nil
+}